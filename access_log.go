@@ -0,0 +1,107 @@
+package gorvp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/urfave/negroni"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessLogEntry is one line of the access log, the identity fields are
+// filled by JwtProxy and the token endpoint while the request is served.
+type AccessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Method       string    `json:"method"`
+	Host         string    `json:"host"`
+	Path         string    `json:"path"`
+	Site         string    `json:"site,omitempty"`
+	RemoteIP     string    `json:"remote_ip,omitempty"`
+	Route        string    `json:"route,omitempty"`
+	Backend      string    `json:"backend,omitempty"`
+	Status       int       `json:"status"`
+	Latency      float64   `json:"latency_ms"`
+	Bytes        int       `json:"bytes"`
+	Subject      string    `json:"sub,omitempty"`
+	ClientID     string    `json:"aud,omitempty"`
+	ConnectionID string    `json:"cni,omitempty"`
+	Scopes       []string  `json:"scopes,omitempty"`
+}
+
+// AccessLogger is a negroni middleware writing one json object per request.
+type AccessLogger struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func NewAccessLogger(doc AccessLogDocument) *AccessLogger {
+	var out io.Writer
+	switch doc.Path {
+	case "":
+		// entries are still collected for the metrics
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		out = &lumberjack.Logger{
+			Filename:   doc.Path,
+			MaxSize:    doc.MaxSize,
+			MaxBackups: doc.MaxBackups,
+			MaxAge:     doc.MaxAge,
+			Compress:   doc.Compress,
+		}
+	}
+	return &AccessLogger{out: out}
+}
+
+func (l *AccessLogger) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	entry := &AccessLogEntry{
+		Time:      start,
+		RequestID: GetRequestID(r),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+	}
+	if ip := RealIP(r); ip != nil {
+		entry.RemoteIP = ip.String()
+	}
+
+	next(rw, r.WithContext(context.WithValue(r.Context(), accessLogKey, entry)))
+
+	res := rw.(negroni.ResponseWriter)
+	entry.Status = res.Status()
+	entry.Bytes = res.Size()
+	entry.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+	l.write(entry)
+}
+
+func (l *AccessLogger) write(entry *AccessLogEntry) {
+	if l.out == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		debug("can not encode access log entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(line)
+}
+
+// GetAccessLogEntry returns the entry of the current request, nil if the
+// access log is disabled.
+func GetAccessLogEntry(r *http.Request) *AccessLogEntry {
+	entry, _ := r.Context().Value(accessLogKey).(*AccessLogEntry)
+	return entry
+}
@@ -7,12 +7,16 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/ory-am/fosite"
 	"strings"
+	"time"
 )
 
 type AdminHandler struct {
-	Router *mux.Router
-	Routes Routes
-	Store  *Store
+	Router  *mux.Router
+	Routes  Routes
+	Store   *Store
+	Keyring *Keyring
+	// device clients can only be created if the device authorization grant is served
+	DeviceFlow bool
 }
 
 type Route struct {
@@ -23,12 +27,16 @@ type Route struct {
 }
 
 type CreateClientRequest struct {
-	Name    string `json:"name"`
-	AppType string `json:"app_type"`
-	Scopes  Scopes `json:"scope"`
-	Trusted bool   `json:"trusted"`
+	Name        string `json:"name"`
+	AppType     string `json:"app_type"`
+	Scopes      Scopes `json:"scope"`
+	Trusted     bool   `json:"trusted"`
+	RequirePKCE bool   `json:"require_pkce"`
 	OAuthData
 	AndroidData
+	IOSData
+	PublicKeysData
+	IPRulesData
 }
 
 type UpdateClientRequest struct {
@@ -39,14 +47,27 @@ type UpdateClientRequest struct {
 	ScopesJSON    string     `json:"-"`
 	Trusted       bool       `json:"trusted,omitempty"`
 	Public        bool       `json:"public,omitempty"`
+	RequirePKCE   bool       `json:"require_pkce,omitempty"`
 
 	// OAuthData
-	RedirectURI   string     `json:"redirect_uri,omitempty"`
+	RedirectURI      string   `json:"redirect_uri,omitempty"`
+	RedirectURIs     []string `gorm:"-" json:"redirect_uris,omitempty"`
+	RedirectURIsJSON string   `json:"-"`
 
 	// AndroidData
 	StartActivity string     `json:"start_activity,omitempty"`
 	PackageName   string     `json:"package_name,omitempty"`
 	KeyHash       string     `json:"key_hash,omitempty"`
+
+	// IOSData
+	BundleID      string     `json:"bundle_id,omitempty"`
+	TeamID        string     `json:"team_id,omitempty"`
+
+	// IPRulesData
+	AllowCIDRs     ConfigCIDRs `json:"allow_cidrs,omitempty"`
+	AllowCIDRsJSON string      `json:"-"`
+	DenyCIDRs      ConfigCIDRs `json:"deny_cidrs,omitempty"`
+	DenyCIDRsJSON  string      `json:"-"`
 }
 
 type ScopeResponse struct {
@@ -56,6 +77,16 @@ type ScopeResponse struct {
 	Required    bool   `json:"required"`
 }
 
+type SigningKeyResponse struct {
+	ID          string    `json:"kid"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatedAt time.Time `json:"activated_at"`
+	RotatedAt   time.Time `json:"rotated_at"`
+	RetiredAt   time.Time `json:"retired_at"`
+	Signing     bool      `json:"signing"`
+}
+
 type ResetPasswordResponse struct {
 	Password string `json:"password"`
 }
@@ -76,12 +107,12 @@ func (h *AdminHandler) Auth(w http.ResponseWriter, r *http.Request) (error) {
 
 func (h *AdminHandler) GetClients(w http.ResponseWriter, r *http.Request) {
 	if err := h.Auth(w, r); err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	clients, err := h.Store.GetRvpClients()
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
@@ -90,21 +121,21 @@ func (h *AdminHandler) GetClients(w http.ResponseWriter, r *http.Request) {
 
 func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 	if err := h.Auth(w, r); err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	decoder := json.NewDecoder(r.Body)
 	createClientRequest := CreateClientRequest{}
 	err := decoder.Decode(&createClientRequest)
 	if err != nil {
-		WriteError(w, ErrInvalidRequest)
+		WriteRequestError(w, r, ErrInvalidRequest)
 		return
 	}
 	// check if the name is same as the trusted client
 	duplicateClient := &GoRvpClient{Name: createClientRequest.Name}
 	err = h.Store.DB.Where(duplicateClient).First(duplicateClient).Error
 	if err == nil && duplicateClient.Trusted {
-		WriteError(w, ErrDuplicateTrustedClientName)
+		WriteRequestError(w, r, ErrDuplicateTrustedClientName)
 		return
 	}
 
@@ -113,24 +144,26 @@ func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 	// | AppType     | GrantTypes         | ResponseTypes | Data Type   | Public |
 	// ---------------------------------------------------------------------------
 	// | web_backend | authorization_code | code, token   | OAuthData   | no     |
-	// | web_app     | implicit           | token         | OAuthData   | yes    |
-	// | android     | implicit           | token         | AndroidData | yes    |
-	// | ios         | implicit           | token         |             | yes    |
+	// | web_app     | implicit, code     | code, token   | OAuthData   | yes    |
+	// | android     | implicit, code     | code, token   | AndroidData | yes    |
+	// | ios         | implicit, code     | code, token   | IOSData     | yes    |
+	// | native      | code               | code          | OAuthData   | yes    |
+	// | device      | device_code        |               |             | yes    |
 	// | trusted     | password           | token         |             | no     |
-	// | client      | client_credentials | token         |             | no     |
+	// | client      | client_credentials | token         | JWKS        | no     |
+	// |             | jwt-bearer         |               |             |        |
 	// ===========================================================================
 	client := GoRvpClient{
-		ID:      uuid.New(),
-		Name:    createClientRequest.Name,
-		AppType: createClientRequest.AppType,
+		ID:          uuid.New(),
+		Name:        createClientRequest.Name,
+		AppType:     createClientRequest.AppType,
+		RequirePKCE: createClientRequest.RequirePKCE,
 	}
 
 	switch createClientRequest.AppType {
 	case AppTypeWebBackend:
-		client.RedirectURI = createClientRequest.RedirectURI
 		client.Public = false
 	case AppTypeWebApp:
-		client.RedirectURI = createClientRequest.RedirectURI
 		client.Public = true
 	case AppTypeAndroid:
 		client.StartActivity = createClientRequest.StartActivity
@@ -138,11 +171,22 @@ func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 		client.KeyHash = strings.ToLower(createClientRequest.KeyHash)
 		client.Public = true
 	case AppTypeIos:
-		// not implemented yet
-		WriteError(w, ErrUnsupportedAppType)
-		return
+		if err := createClientRequest.IOSData.Validate(); err != nil {
+			WriteRequestError(w, r, err)
+			return
+		}
+		client.IOSData = createClientRequest.IOSData
+		client.Public = true
+	case AppTypeNative:
+		client.Public = true
+		client.RequirePKCE = true
+	case AppTypeDevice:
+		if !h.DeviceFlow {
+			WriteRequestError(w, r, ErrUnsupportedAppType)
+			return
+		}
+		client.Public = true
 	case AppTypeOwner:
-		client.RedirectURI = createClientRequest.RedirectURI
 		client.Public = false
 		if createClientRequest.Trusted {
 			client.Trusted = createClientRequest.Trusted
@@ -150,17 +194,50 @@ func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 	case AppTypeClient:
 		client.Public = false
 	default:
-		WriteError(w, ErrUnsupportedAppType)
+		WriteRequestError(w, r, ErrUnsupportedAppType)
+		return
+	}
+
+	// redirect_uri is the single redirect uri of the former api
+	redirectURIs := createClientRequest.RedirectURIs
+	if createClientRequest.RedirectURI != "" && !stringIn(createClientRequest.RedirectURI, redirectURIs) {
+		redirectURIs = append([]string{createClientRequest.RedirectURI}, redirectURIs...)
+	}
+	if len(redirectURIs) == 0 && (client.AppType == AppTypeAndroid || client.AppType == AppTypeIos || client.AppType == AppTypeNative) {
+		WriteRequestError(w, r, ErrInvalidRequest)
 		return
 	}
+	for _, redirectURI := range redirectURIs {
+		if err := client.ValidateRedirectURI(redirectURI); err != nil {
+			WriteRequestError(w, r, err)
+			return
+		}
+	}
+	client.SetRedirectURIs(redirectURIs)
+
+	if err := client.SetJWKS(createClientRequest.JWKS); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+
 	scopeJson, _ := json.Marshal(createClientRequest.Scopes)
 	client.ScopesJSON = string(scopeJson)
 
+	err = client.SetIPRules(createClientRequest.AllowCIDRs, createClientRequest.DenyCIDRs)
+	if err != nil {
+		WriteRequestError(w, r, ErrInvalidRequest)
+		return
+	}
+
 	//grantJson, _ := json.Marshal(&client.Grant)
 	//client.GrantJSON = string(grantJson)
 
 	// generate client secret
 	unEncryptedSecret, _ := client.ResetPassword()
+	if client.JWKS != nil {
+		// the client authenticates with its keys, the secret is never handed out
+		unEncryptedSecret = ""
+	}
 
 	// save new client into database
 	h.Store.DB.Create(&client)
@@ -176,7 +253,7 @@ func (h *AdminHandler) CreateClient(w http.ResponseWriter, r *http.Request) {
 
 func (h *AdminHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
 	if err := h.Auth(w, r); err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -185,7 +262,7 @@ func (h *AdminHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
 	updateClient := UpdateClientRequest{}
 	err := decoder.Decode(&updateClient)
 	if err != nil {
-		WriteError(w, ErrInvalidRequest)
+		WriteRequestError(w, r, ErrInvalidRequest)
 		return
 	}
 	if updateClient.Scopes != nil {
@@ -193,19 +270,33 @@ func (h *AdminHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
 		scopeJson := string(scopeJsonBytes)
 		updateClient.ScopesJSON = string(scopeJson)
 	}
+	if updateClient.AllowCIDRs != nil || updateClient.DenyCIDRs != nil {
+		if _, err := NewIPFilter(updateClient.AllowCIDRs, updateClient.DenyCIDRs); err != nil {
+			WriteRequestError(w, r, ErrInvalidRequest)
+			return
+		}
+	}
+	if updateClient.AllowCIDRs != nil {
+		allowJson, _ := json.Marshal(updateClient.AllowCIDRs)
+		updateClient.AllowCIDRsJSON = string(allowJson)
+	}
+	if updateClient.DenyCIDRs != nil {
+		denyJson, _ := json.Marshal(updateClient.DenyCIDRs)
+		updateClient.DenyCIDRsJSON = string(denyJson)
+	}
 
 	// find current client
 	vars := mux.Vars(r)
 	clientID := vars["id"]
 	currentClient, err := h.Store.GetRvpClient(clientID)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
 	// change app type is not allowed
 	if (updateClient.AppType != "") && (currentClient.AppType != updateClient.AppType) {
-		WriteError(w, ErrModAppTypeNotAllowed)
+		WriteRequestError(w, r, ErrModAppTypeNotAllowed)
 		return
 	}
 
@@ -214,18 +305,146 @@ func (h *AdminHandler) UpdateClient(w http.ResponseWriter, r *http.Request) {
 		updateClient.KeyHash = strings.ToLower(updateClient.KeyHash)
 	}
 
+	// the redirect uris are replaced, redirect_uri replaces them with a single one
+	if updateClient.RedirectURIs == nil && updateClient.RedirectURI != "" {
+		updateClient.RedirectURIs = []string{updateClient.RedirectURI}
+	}
+	if updateClient.RedirectURIs != nil {
+		for _, redirectURI := range updateClient.RedirectURIs {
+			if err := currentClient.ValidateRedirectURI(redirectURI); err != nil {
+				WriteRequestError(w, r, err)
+				return
+			}
+		}
+		redirectURIs := &GoRvpClient{}
+		redirectURIs.SetRedirectURIs(updateClient.RedirectURIs)
+		updateClient.RedirectURI = redirectURIs.RedirectURI
+		updateClient.RedirectURIsJSON = redirectURIs.RedirectURIsJSON
+	}
+
+	if currentClient.AppType == AppTypeIos {
+		iosData := currentClient.IOSData
+		if updateClient.BundleID != "" {
+			iosData.BundleID = updateClient.BundleID
+		}
+		if updateClient.TeamID != "" {
+			iosData.TeamID = updateClient.TeamID
+		}
+		if err := iosData.Validate(); err != nil {
+			WriteRequestError(w, r, err)
+			return
+		}
+	}
+
 	err = h.Store.DB.Model(&currentClient).Updates(updateClient).Error
 	if err != nil {
-		WriteError(w, ErrDatabase)
+		WriteRequestError(w, r, ErrDatabase)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(currentClient)
 }
 
+type RedirectURIRequest struct {
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// AddRedirectURI registers one more redirect uri of the client.
+func (h *AdminHandler) AddRedirectURI(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	redirectURIRequest := RedirectURIRequest{}
+	err := json.NewDecoder(r.Body).Decode(&redirectURIRequest)
+	if err != nil {
+		WriteRequestError(w, r, ErrInvalidRequest)
+		return
+	}
+	client, err := h.Store.GetRvpClient(mux.Vars(r)["id"])
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if err := client.ValidateRedirectURI(redirectURIRequest.RedirectURI); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if !stringIn(redirectURIRequest.RedirectURI, client.RedirectURIs) {
+		client.SetRedirectURIs(append(client.RedirectURIs, redirectURIRequest.RedirectURI))
+		if err := h.Store.UpdateRedirectURIs(client); err != nil {
+			WriteRequestError(w, r, err)
+			return
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// RemoveRedirectURI unregisters the redirect uri in the redirect_uri query parameter.
+func (h *AdminHandler) RemoveRedirectURI(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	client, err := h.Store.GetRvpClient(mux.Vars(r)["id"])
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	if !stringIn(redirectURI, client.RedirectURIs) {
+		WriteRequestError(w, r, ErrRecordNotFound)
+		return
+	}
+	redirectURIs := []string{}
+	for _, registered := range client.RedirectURIs {
+		if registered != redirectURI {
+			redirectURIs = append(redirectURIs, registered)
+		}
+	}
+	client.SetRedirectURIs(redirectURIs)
+	if err := h.Store.UpdateRedirectURIs(client); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// ReplaceJWKS replaces the public keys of a service client, an empty key set
+// removes them.
+func (h *AdminHandler) ReplaceJWKS(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	keySet := &JSONWebKeySet{}
+	err := json.NewDecoder(r.Body).Decode(keySet)
+	if err != nil {
+		WriteRequestError(w, r, ErrInvalidRequest)
+		return
+	}
+	client, err := h.Store.GetRvpClient(mux.Vars(r)["id"])
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if err := client.SetJWKS(keySet); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if err := h.Store.UpdateJWKS(client); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
 func (h *AdminHandler) DeleteClient(w http.ResponseWriter, r *http.Request) {
 	if err := h.Auth(w, r); err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -233,14 +452,14 @@ func (h *AdminHandler) DeleteClient(w http.ResponseWriter, r *http.Request) {
 	clientID := vars["id"]
 	err := h.Store.DeleteClient(clientID)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 }
 
 func (h *AdminHandler) ResetClientPassword(w http.ResponseWriter, r *http.Request) {
 	if err := h.Auth(w, r); err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -248,7 +467,7 @@ func (h *AdminHandler) ResetClientPassword(w http.ResponseWriter, r *http.Reques
 	clientID := vars["id"]
 	newPassword, err := h.Store.ResetClientPassword(clientID)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -257,6 +476,59 @@ func (h *AdminHandler) ResetClientPassword(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(resetPasswordResponse)
 }
 
+func (h *AdminHandler) GetKeys(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewSigningKeyResponses(h.Keyring))
+}
+
+func (h *AdminHandler) RotateKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	_, err := h.Keyring.Rotate()
+	if err != nil {
+		WriteRequestError(w, r, ErrServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewSigningKeyResponses(h.Keyring))
+}
+
+func (h *AdminHandler) RetireKey(w http.ResponseWriter, r *http.Request) {
+	if err := h.Auth(w, r); err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	err := h.Keyring.Retire(mux.Vars(r)["kid"])
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+}
+
+// NewSigningKeyResponses lists the keys of keyring without the private keys.
+func NewSigningKeyResponses(keyring *Keyring) []SigningKeyResponse {
+	signing := keyring.SigningKey()
+	var responses []SigningKeyResponse
+	for _, key := range keyring.Keys() {
+		responses = append(responses, SigningKeyResponse{
+			ID:          key.ID,
+			State:       key.State,
+			CreatedAt:   key.CreatedAt,
+			ActivatedAt: key.ActivatedAt,
+			RotatedAt:   key.RotatedAt,
+			RetiredAt:   key.RetiredAt,
+			Signing:     key == signing,
+		})
+	}
+	return responses
+}
+
 func (h *AdminHandler) SetupHandler() {
 	h.Routes = Routes{
 		Route{
@@ -289,6 +561,42 @@ func (h *AdminHandler) SetupHandler() {
 			"/client/{id}/reset_password",
 			h.ResetClientPassword,
 		},
+		Route{
+			"Add client redirect uri",
+			"POST",
+			"/client/{id}/redirect_uris",
+			h.AddRedirectURI,
+		},
+		Route{
+			"Remove client redirect uri",
+			"DELETE",
+			"/client/{id}/redirect_uris",
+			h.RemoveRedirectURI,
+		},
+		Route{
+			"Replace client public keys",
+			"PUT",
+			"/client/{id}/jwks",
+			h.ReplaceJWKS,
+		},
+		Route{
+			"Get signing keys",
+			"GET",
+			"/keys",
+			h.GetKeys,
+		},
+		Route{
+			"Rotate signing key",
+			"POST",
+			"/keys/rotate",
+			h.RotateKey,
+		},
+		Route{
+			"Retire signing key",
+			"DELETE",
+			"/keys/{kid}",
+			h.RetireKey,
+		},
 	}
 	for _, route := range h.Routes {
 		h.Router.
@@ -0,0 +1,168 @@
+package gorvp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/ory-am/fosite"
+	"github.com/pkg/errors"
+)
+
+// ClientAssertionTypeJWTBearer is the client_assertion_type of the clients
+// authenticating with a jwt signed by their key, private_key_jwt (RFC 7523 section 2.2).
+const ClientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// the jti of an assertion is kept until it expires, so assertions have to be short-lived
+const maxAssertionLifespan = time.Hour
+
+// verifyAssertion checks the signature and the claims of a jwt assertion the
+// client signed for itself (RFC 7523 section 3), it returns its jti and expiry.
+func verifyAssertion(client *GoRvpClient, assertion string, audiences []string) (string, time.Time, error) {
+	token, err := jwtgo.Parse(assertion, func(t *jwtgo.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		jwk, err := client.PublicKey(kid)
+		if err != nil {
+			return nil, errors.Errorf("no key %s registered", kid)
+		}
+		if t.Method.Alg() != jwk.Algorithm {
+			return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return jwk.PublicKey()
+	})
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "invalid assertion")
+	}
+	claims, ok := token.Claims.(jwtgo.MapClaims)
+	if !ok || !token.Valid {
+		return "", time.Time{}, errors.New("invalid assertion")
+	}
+	if claims["iss"] != client.ID || claims["sub"] != client.ID {
+		return "", time.Time{}, errors.New("the assertion is not issued by the client for itself")
+	}
+	if !audienceIn(claims["aud"], audiences) {
+		return "", time.Time{}, errors.New("the assertion is issued for another audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", time.Time{}, errors.New("the assertion has no expiry")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if time.Until(expiresAt) > maxAssertionLifespan {
+		return "", time.Time{}, errors.New("the assertion lives too long")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", time.Time{}, errors.New("the assertion has no jti")
+	}
+	return jti, expiresAt, nil
+}
+
+// audienceIn reports whether the aud claim, a string or an array, contains
+// one of audiences.
+func audienceIn(aud interface{}, audiences []string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return stringIn(aud, audiences)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && stringIn(s, audiences) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assertionIssuer returns the iss claim of an assertion before it is verified,
+// to find the client and its keys.
+func assertionIssuer(assertion string) (string, bool) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Issuer == "" {
+		return "", false
+	}
+	return claims.Issuer, true
+}
+
+// clientAssertionOf returns the client and the assertion of a request
+// authenticated with private_key_jwt, ok is false if it has no client assertion.
+func clientAssertionOf(req *http.Request) (clientID string, assertion string, ok bool) {
+	if req.PostForm.Get("client_assertion_type") != ClientAssertionTypeJWTBearer {
+		return "", "", false
+	}
+	assertion = req.PostForm.Get("client_assertion")
+	clientID, ok = assertionIssuer(assertion)
+	if !ok || (req.PostForm.Get("client_id") != "" && req.PostForm.Get("client_id") != clientID) {
+		return "", "", false
+	}
+	return clientID, assertion, true
+}
+
+// assertionHasher lets the clients authenticated with an assertion pass the
+// secret check of fosite, which only compares the secret of the basic auth
+// with the hashed secret of the client. Once gorvp verified the assertion, the
+// basic auth carries a one-time secret bound to the hashed secret of the client.
+type assertionHasher struct {
+	fosite.Hasher
+	verified sync.Map
+}
+
+// pass returns the one-time secret of client, verified with an assertion.
+func (h *assertionHasher) pass(client fosite.Client) (string, error) {
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(r)
+	h.verified.Store(secret, client.GetHashedSecret())
+	return secret, nil
+}
+
+// forget drops the one-time secret, if fosite did not compare it.
+func (h *assertionHasher) forget(secret string) {
+	h.verified.Delete(secret)
+}
+
+func (h *assertionHasher) Compare(hash, data []byte) error {
+	if hashedSecret, ok := h.verified.LoadAndDelete(string(data)); ok {
+		// the hash is the one of the client being authenticated, which has to
+		// be the client verified
+		if len(hash) == 0 || subtle.ConstantTimeCompare(hash, hashedSecret.([]byte)) != 1 {
+			return ErrInvalidClient
+		}
+		return nil
+	}
+	return h.Hasher.Compare(hash, data)
+}
+
+// authenticateAssertion verifies the assertion of a client with public keys,
+// which then passes the secret check of fosite with the returned secret.
+func (goRvp *GoRvp) authenticateAssertion(ctx context.Context, clientID string, assertion string) (string, error) {
+	client, err := goRvp.store.GetRvpClient(clientID)
+	if err != nil || client.JWKS == nil {
+		return "", ErrInvalidClient
+	}
+	if err := goRvp.store.VerifyAssertion(ctx, clientID, assertion); err != nil {
+		debug("client %s: %s", clientID, err)
+		return "", ErrInvalidClient
+	}
+	return goRvp.assertionHasher.pass(client)
+}
@@ -0,0 +1,141 @@
+package gorvp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"golang.org/x/net/context"
+)
+
+const testAudience = "https://gorvp.example.com/oauth/token"
+
+// newTestServiceClient returns a client with the public key of the returned key.
+func newTestServiceClient(t *testing.T, id string) (*GoRvpClient, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &GoRvpClient{ID: id, AppType: AppTypeClient}
+	if err := client.SetJWKS(&JSONWebKeySet{Keys: []JSONWebKey{NewJSONWebKey(&key.PublicKey)}}); err != nil {
+		t.Fatal(err)
+	}
+	return client, key
+}
+
+// assertionClaims are valid claims of an assertion of the client for itself.
+func assertionClaims(clientID string, jti string) jwtgo.MapClaims {
+	return jwtgo.MapClaims{
+		"iss": clientID,
+		"sub": clientID,
+		"aud": testAudience,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+		"jti": jti,
+	}
+}
+
+func signAssertion(t *testing.T, method jwtgo.SigningMethod, key interface{}, kid string, claims jwtgo.MapClaims) string {
+	token := jwtgo.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	assertion, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	client, key := newTestServiceClient(t, "service")
+	_, otherKey := newTestServiceClient(t, "other")
+	kid := client.JWKS.Keys[0].KeyID
+
+	for _, c := range []struct {
+		name   string
+		method jwtgo.SigningMethod
+		key    interface{}
+		kid    string
+		change func(claims jwtgo.MapClaims)
+		valid  bool
+	}{
+		{"valid assertion", jwtgo.SigningMethodES256, key, kid, nil, true},
+		{"single key without kid", jwtgo.SigningMethodES256, key, "", nil, true},
+		{"audience in an array", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["aud"] = []string{"https://other.example.com", testAudience}
+		}, true},
+		{"wrong audience", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["aud"] = "https://other.example.com"
+		}, false},
+		{"missing audience", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			delete(claims, "aud")
+		}, false},
+		{"missing expiry", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			delete(claims, "exp")
+		}, false},
+		{"expired", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		}, false},
+		{"living too long", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["exp"] = time.Now().Add(maxAssertionLifespan + time.Minute).Unix()
+		}, false},
+		{"issuer is not the subject", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["sub"] = "user"
+		}, false},
+		{"issued by another client", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			claims["iss"] = "other"
+			claims["sub"] = "other"
+		}, false},
+		{"missing jti", jwtgo.SigningMethodES256, key, kid, func(claims jwtgo.MapClaims) {
+			delete(claims, "jti")
+		}, false},
+		{"algorithm of another key type", jwtgo.SigningMethodHS256, []byte(kid), kid, nil, false},
+		{"unknown kid", jwtgo.SigningMethodES256, key, "unknown", nil, false},
+		{"signed with another key", jwtgo.SigningMethodES256, otherKey, kid, nil, false},
+	} {
+		claims := assertionClaims(client.ID, "jti")
+		if c.change != nil {
+			c.change(claims)
+		}
+		assertion := signAssertion(t, c.method, c.key, c.kid, claims)
+
+		jti, _, err := verifyAssertion(client, assertion, []string{testAudience})
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+		if c.valid && jti != "jti" {
+			t.Errorf("%s: unexpected jti %s", c.name, jti)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestVerifyAssertionReplay(t *testing.T) {
+	store := newTestStore(t)
+	store.AssertionAudiences = []string{testAudience}
+	client, key := newTestServiceClient(t, "service")
+	createTestClient(t, store, client)
+	otherClient, otherKey := newTestServiceClient(t, "other")
+	createTestClient(t, store, otherClient)
+
+	assertion := signAssertion(t, jwtgo.SigningMethodES256, key, "", assertionClaims("service", "jti"))
+	if err := store.VerifyAssertion(context.Background(), "service", assertion); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := store.VerifyAssertion(context.Background(), "service", assertion); err == nil {
+		t.Error("expected the replayed assertion to fail")
+	}
+	// the jti is unique per client
+	otherAssertion := signAssertion(t, jwtgo.SigningMethodES256, otherKey, "", assertionClaims("other", "jti"))
+	if err := store.VerifyAssertion(context.Background(), "other", otherAssertion); err != nil {
+		t.Errorf("unexpected error %s for the jti of another client", err)
+	}
+	if err := store.VerifyAssertion(context.Background(), "unknown", assertion); err == nil {
+		t.Error("expected the assertion of an unknown client to fail")
+	}
+}
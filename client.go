@@ -7,10 +7,14 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"encoding/hex"
 	"crypto/rand"
+	"regexp"
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
 )
 
 const AppTypeAndroid = "android"
 const AppTypeIos = "ios"
+const AppTypeNative = "native"
+const AppTypeDevice = "device"
 const AppTypeWebApp = "web_app"
 const AppTypeWebBackend = "web_backend"
 const AppTypeOwner = "owner"
@@ -18,7 +22,10 @@ const AppTypeClient = "client"
 
 // Grant data
 type OAuthData struct {
-	RedirectURI string `json:"redirect_uri"`
+	// the first of RedirectURIs, the only one of the clients registered before
+	RedirectURI      string   `json:"redirect_uri"`
+	RedirectURIs     []string `gorm:"-" json:"redirect_uris"`
+	RedirectURIsJSON string   `gorm:"size:4095" json:"-"`
 }
 
 // Grant data
@@ -28,20 +35,50 @@ type AndroidData struct {
 	KeyHash       string `json:"key_hash"`
 }
 
+var (
+	bundleIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)+$`)
+	teamIDPattern   = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+)
+
+// Grant data
+type IOSData struct {
+	BundleID string `json:"bundle_id"`
+	TeamID   string `json:"team_id"`
+}
+
+// Public keys of a service client, verifying its jwt assertions instead of a secret
+type PublicKeysData struct {
+	JWKS     *JSONWebKeySet `gorm:"-" json:"jwks,omitempty"`
+	JWKSJSON string         `gorm:"column:jwks_json;size:8191" json:"-"`
+}
+
+// Network restriction
+type IPRulesData struct {
+	AllowCIDRs     ConfigCIDRs `gorm:"-" json:"allow_cidrs"`
+	AllowCIDRsJSON string      `gorm:"size:1023" json:"-"`
+	DenyCIDRs      ConfigCIDRs `gorm:"-" json:"deny_cidrs"`
+	DenyCIDRsJSON  string      `gorm:"size:1023" json:"-"`
+}
+
 type GoRvpClient struct {
-	ID         string     `gorm:"primary_key" json:"id"`
-	CreatedAt  time.Time  `json:"created_at"`
-	UpdatedAt  time.Time  `json:"updated_at"`
-	DeletedAt  *time.Time `sql:"index" json:"-"`
-	Name       string     `json:"name"`
-	Secret     string     `json:"-"`
-	AppType    string     `json:"app_type"`
-	Scopes     Scopes     `gorm:"-" json:"scopes"`
-	ScopesJSON string     `gorm:"size:1023" json:"-"`
-	Trusted    bool       `json:"trusted"`
-	Public     bool       `json:"public"`
+	ID          string     `gorm:"primary_key" json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeletedAt   *time.Time `sql:"index" json:"-"`
+	Name        string     `json:"name"`
+	Secret      string     `json:"-"`
+	AppType     string     `json:"app_type"`
+	Scopes      Scopes     `gorm:"-" json:"scopes"`
+	ScopesJSON  string     `gorm:"size:1023" json:"-"`
+	Trusted     bool       `json:"trusted"`
+	Public      bool       `json:"public"`
+	// the authorization code requests need a PKCE code challenge
+	RequirePKCE bool       `json:"require_pkce"`
 	OAuthData
 	AndroidData
+	IOSData
+	PublicKeysData
+	IPRulesData
 }
 
 type Client interface {
@@ -51,8 +88,13 @@ type Client interface {
 	GetPackageName() string
 	GetKeyHash() string
 	GetStartActivity() string
+	GetBundleID() string
+	GetTeamID() string
 	IsTrusted() bool
+	IsPublic() bool
+	IsPKCERequired() bool
 	GetName() string
+	GetIPFilter() *IPFilter
 	ResetPassword() (string, error)
 }
 
@@ -82,19 +124,101 @@ func (c *GoRvpClient) GetHashedSecret() []byte {
 
 // Returns the client's allowed redirect URIs.
 func (c *GoRvpClient) GetRedirectURIs() []string {
-	// TODO refactoring
-	if c.AppType == AppTypeAndroid {
-		//return []string{"ncku://"}
-		// TODO currently fosite does not allows non https as a redirect uri,
-		// but https is not necessary needed on Android for redirection,
-		// one can register a custom schema which allows user login via browser and redirect the access token
-		// back to native app
-		return []string{"http://localhost"}
-	} else {
-		return []string{c.RedirectURI}
+	return c.RedirectURIs
+}
+
+// ValidateRedirectURI checks whether redirectURI can be registered for the app
+// type of the client.
+func (c *GoRvpClient) ValidateRedirectURI(redirectURI string) error {
+	switch c.AppType {
+	case AppTypeNative, AppTypeAndroid:
+		return validNativeRedirectURI(redirectURI, true)
+	case AppTypeIos:
+		// ios apps can not listen on a loopback port
+		return validNativeRedirectURI(redirectURI, false)
+	case AppTypeWebBackend, AppTypeWebApp, AppTypeOwner:
+		return validWebRedirectURI(redirectURI)
+	}
+	return ErrInvalidRequest
+}
+
+// SetRedirectURIs replaces the registered redirect uris.
+func (c *GoRvpClient) SetRedirectURIs(redirectURIs []string) {
+	c.RedirectURIs = redirectURIs
+	c.RedirectURI = ""
+	if len(redirectURIs) > 0 {
+		c.RedirectURI = redirectURIs[0]
+	}
+	redirectURIsJson, _ := json.Marshal(redirectURIs)
+	c.RedirectURIsJSON = string(redirectURIsJson)
+}
+
+func (c *GoRvpClient) UnmarshalRedirectURIsJSON() {
+	c.RedirectURIs = nil
+	json.Unmarshal([]byte(c.RedirectURIsJSON), &c.RedirectURIs)
+	if len(c.RedirectURIs) == 0 && c.RedirectURI != "" {
+		c.RedirectURIs = []string{c.RedirectURI}
+	}
+}
+
+// SetJWKS replaces the public keys of the client, the keys without a kid get
+// their thumbprint.
+func (c *GoRvpClient) SetJWKS(keySet *JSONWebKeySet) error {
+	if keySet == nil || len(keySet.Keys) == 0 {
+		c.JWKS = nil
+		c.JWKSJSON = ""
+		return nil
+	}
+	if c.AppType != AppTypeClient {
+		return ErrInvalidRequest
+	}
+	for i, jwk := range keySet.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return ErrInvalidRequest
+		}
+		keySet.Keys[i].Algorithm, _ = AlgorithmOf(key)
+		keySet.Keys[i].Use = "sig"
+		if jwk.KeyID == "" {
+			keySet.Keys[i].KeyID = KeyID(key)
+		}
+	}
+	c.JWKS = keySet
+	jwksJson, _ := json.Marshal(keySet)
+	c.JWKSJSON = string(jwksJson)
+	return nil
+}
+
+func (c *GoRvpClient) UnmarshalJWKSJSON() {
+	c.JWKS = nil
+	if c.JWKSJSON != "" {
+		c.JWKS = &JSONWebKeySet{}
+		json.Unmarshal([]byte(c.JWKSJSON), c.JWKS)
 	}
 }
 
+// PublicKey returns the registered key of kid, which may be omitted if the
+// client has a single key.
+func (c *GoRvpClient) PublicKey(kid string) (JSONWebKey, error) {
+	if c.JWKS == nil {
+		return JSONWebKey{}, ErrInvalidClient
+	}
+	for _, jwk := range c.JWKS.Keys {
+		if jwk.KeyID == kid || (kid == "" && len(c.JWKS.Keys) == 1) {
+			return jwk, nil
+		}
+	}
+	return JSONWebKey{}, ErrInvalidClient
+}
+
+// Validate checks the bundle id and the team id of an ios client.
+func (d *IOSData) Validate() error {
+	if !bundleIDPattern.MatchString(d.BundleID) || !teamIDPattern.MatchString(d.TeamID) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
 // Returns the client's allowed grant types.
 func (c *GoRvpClient) GetGrantTypes() fosite.Arguments {
 	// TODO refactoring
@@ -102,15 +226,19 @@ func (c *GoRvpClient) GetGrantTypes() fosite.Arguments {
 	case AppTypeWebBackend:
 		return []string{"authorization_code", "refresh_token"}
 	case AppTypeWebApp:
-		return []string{"implicit"}
+		return []string{"authorization_code", "implicit"}
 	case AppTypeAndroid:
-		return []string{"implicit", "refresh_token"}
+		return []string{"authorization_code", "implicit", "refresh_token"}
 	case AppTypeIos:
-		return []string{"implicit", "refresh_token"}
+		return []string{"authorization_code", "implicit", "refresh_token"}
+	case AppTypeNative:
+		return []string{"authorization_code", "refresh_token"}
+	case AppTypeDevice:
+		return []string{gorvpOauth2.GrantTypeDeviceCode, "refresh_token"}
 	case AppTypeOwner:
 		return []string{"password"}
 	case AppTypeClient:
-		return []string{"client_credentials"}
+		return []string{"client_credentials", gorvpOauth2.GrantTypeJWTBearer}
 	}
 	return []string{}
 }
@@ -120,13 +248,15 @@ func (c *GoRvpClient) GetResponseTypes() fosite.Arguments {
 	// TODO refactoring
 	switch c.AppType {
 	case AppTypeWebBackend:
-		return fosite.Arguments{"code", "token"}
+		return fosite.Arguments{"code", "token", "id_token"}
 	case AppTypeWebApp:
-		return fosite.Arguments{"token"}
+		return fosite.Arguments{"code", "token", "id_token"}
 	case AppTypeAndroid:
-		return fosite.Arguments{"token"}
+		return fosite.Arguments{"code", "token", "id_token"}
 	case AppTypeIos:
-		return fosite.Arguments{"token"}
+		return fosite.Arguments{"code", "token", "id_token"}
+	case AppTypeNative:
+		return fosite.Arguments{"code", "id_token"}
 	case AppTypeOwner:
 		return fosite.Arguments{"token"}
 	case AppTypeClient:
@@ -158,6 +288,31 @@ func (c *GoRvpClient) UnmarshalScopesJSON() {
 	json.Unmarshal([]byte(c.ScopesJSON), &c.Scopes)
 }
 
+func (c *GoRvpClient) UnmarshalIPRulesJSON() {
+	json.Unmarshal([]byte(c.AllowCIDRsJSON), &c.AllowCIDRs)
+	json.Unmarshal([]byte(c.DenyCIDRsJSON), &c.DenyCIDRs)
+}
+
+func (c *GoRvpClient) SetIPRules(allow ConfigCIDRs, deny ConfigCIDRs) error {
+	if _, err := NewIPFilter(allow, deny); err != nil {
+		return err
+	}
+	c.AllowCIDRs = allow
+	c.DenyCIDRs = deny
+	allowJson, _ := json.Marshal(allow)
+	c.AllowCIDRsJSON = string(allowJson)
+	denyJson, _ := json.Marshal(deny)
+	c.DenyCIDRsJSON = string(denyJson)
+	return nil
+}
+
+// GetIPFilter returns the ip rules of the client, nil if there is none.
+func (c *GoRvpClient) GetIPFilter() *IPFilter {
+	// rules are validated before they are saved
+	filter, _ := NewIPFilter(c.AllowCIDRs, c.DenyCIDRs)
+	return filter
+}
+
 func (c *GoRvpClient) GetAppType() string {
 	return c.AppType
 }
@@ -174,10 +329,22 @@ func (c *GoRvpClient) GetStartActivity() string {
 	return c.StartActivity
 }
 
+func (c *GoRvpClient) GetBundleID() string {
+	return c.BundleID
+}
+
+func (c *GoRvpClient) GetTeamID() string {
+	return c.TeamID
+}
+
 func (c *GoRvpClient) IsPublic() bool {
 	return c.Public
 }
 
+func (c *GoRvpClient) IsPKCERequired() bool {
+	return c.RequirePKCE
+}
+
 func (c *GoRvpClient) ResetPassword() (string, error) {
 	passwordLength := 16
 	r := make([]byte, passwordLength)
@@ -191,3 +358,12 @@ func (c *GoRvpClient) ResetPassword() (string, error) {
 	c.Secret = secretString
 	return unEncryptedSecret, nil
 }
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
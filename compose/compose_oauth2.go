@@ -19,3 +19,28 @@ func OAuth2AuthorizeImplicitRefreshFactory(config *fositeCompose.Config, storage
 		ScopeStrategy:       fosite.HierarchicScopeStrategy,
 	}
 }
+
+// OAuth2DeviceCodeFactory creates an OAuth2 device authorization grant (RFC 8628) handler, the tokens are issued
+// once the user approved the device code.
+func OAuth2DeviceCodeFactory(config *fositeCompose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &oauth2.DeviceCodeGrantHandler{
+		AccessTokenStrategy:      strategy.(fositeOauth2.AccessTokenStrategy),
+		RefreshTokenStrategy:     strategy.(fositeOauth2.RefreshTokenStrategy),
+		DeviceCodeStorage:        storage.(oauth2.DeviceCodeStorage),
+		AccessTokenStorage:       storage.(fositeOauth2.AccessTokenStorage),
+		RefreshTokenGrantStorage: storage.(fositeOauth2.RefreshTokenGrantStorage),
+		AccessTokenLifespan:      config.GetAccessTokenLifespan(),
+	}
+}
+
+// OAuth2JWTBearerFactory creates an OAuth2 jwt bearer grant (RFC 7523) handler, the clients exchange assertions
+// signed with their registered keys for access tokens.
+func OAuth2JWTBearerFactory(config *fositeCompose.Config, storage interface{}, strategy interface{}) interface{} {
+	return &oauth2.JWTBearerGrantHandler{
+		AccessTokenStrategy: strategy.(fositeOauth2.AccessTokenStrategy),
+		AssertionStorage:    storage.(oauth2.AssertionStorage),
+		AccessTokenStorage:  storage.(fositeOauth2.AccessTokenStorage),
+		ScopeStrategy:       fosite.HierarchicScopeStrategy,
+		AccessTokenLifespan: config.GetAccessTokenLifespan(),
+	}
+}
@@ -5,15 +5,12 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 	"gopkg.in/yaml.v2"
-	"crypto/rsa"
-	"encoding/pem"
-	"crypto/x509"
-	"log"
-	"crypto/rand"
+	"crypto"
 	"os"
 	"path/filepath"
 	"github.com/go-errors/errors"
 	"time"
+	"net"
 )
 
 type FrontDocument map[string]map[string]Frontend
@@ -27,10 +24,47 @@ type RsaKeyDocument struct {
 	Token RsaKey `yaml:"token"`
 }
 
+// KeyringDocument configures the rotation of the token signing keys, see Keyring.
+type KeyringDocument struct {
+	// "file" or "database", the database keyring is shared by all instances
+	Storage        string        `yaml:"storage"`
+	// the rsa_key.token key is imported when the keyring is created, the
+	// database keyring imports this file instead if it exists
+	Path           string        `yaml:"path"`
+	// file of the master key encrypting the keys in the database, if
+	// GORVP_KEYRING_MASTER_KEY is not set
+	MasterKeyFile  string        `yaml:"master_key_file"`
+	// of the generated keys, RS256, ES256 or EdDSA, RS256 if empty
+	Algorithm      string        `yaml:"algorithm"`
+	// size of the generated RS256 keys, at least 2048, 2048 if 0
+	RSABits        int           `yaml:"rsa_bits"`
+	// seconds a key signs before the next key is activated, 0 disables the rotation
+	RotationPeriod time.Duration `yaml:"rotation_period"`
+	// seconds a key validates tokens after it stopped signing, the refresh token lifespan if 0
+	RetireAfter    time.Duration `yaml:"retire_after"`
+}
+
+// RsaKey is a PEM key pair, despite the name ECDSA P-256 and Ed25519 keys are supported as well.
 type RsaKey struct {
-	Public  string `yaml:"public"`
-	Private string `yaml:"private"`
-	Key     *rsa.PrivateKey
+	Public     string `yaml:"public"`
+	Private    string `yaml:"private"`
+	// for encrypted private keys
+	Passphrase string `yaml:"passphrase"`
+	Key        crypto.Signer
+}
+
+// LoginDocument enables the login and consent pages of the authorize
+// endpoint, for the requests without a token of a trusted client.
+type LoginDocument struct {
+	Enabled         bool          `yaml:"enabled"`
+	// /oauth/login if empty
+	MountPoint      string        `yaml:"mount_point"`
+	// seconds a login lasts, an hour if 0
+	Lifespan        time.Duration `yaml:"lifespan"`
+	// html templates replacing the built-in pages
+	LoginTemplate   string        `yaml:"login_template"`
+	ConsentTemplate string        `yaml:"consent_template"`
+	DeviceTemplate  string        `yaml:"device_template"`
 }
 
 type LifespanConf struct {
@@ -38,6 +72,77 @@ type LifespanConf struct {
 	AccessToken   time.Duration `yaml:"access_token"`
 	RefreshToken  time.Duration `yaml:"refresh_token"`
 	AuthorizeCode time.Duration `yaml:"authorization_code"`
+	// 600 if 0
+	DeviceCode    time.Duration `yaml:"device_code"`
+}
+
+type ServerDocument struct {
+	// second
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// time to wait for in-flight requests on shutdown, 30 seconds by default
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	// byte, 0 means unlimited
+	MaxBodySize       int64         `yaml:"max_body_size"`
+	BufferRequest     bool          `yaml:"buffer_request"`
+}
+
+type AccessLogDocument struct {
+	// "stdout", "stderr" or a file path, empty keeps the plain text log
+	Path       string `yaml:"path"`
+	// rotation of the log file, size in megabytes and age in days
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAge     int    `yaml:"max_age"`
+	Compress   bool   `yaml:"compress"`
+}
+
+type MetricsDocument struct {
+	Enabled bool   `yaml:"enabled"`
+	// address of a dedicated listener, empty to serve on the proxy port
+	Listen  string `yaml:"listen"`
+	Path    string `yaml:"path"`
+}
+
+type TracingDocument struct {
+	Enabled     bool    `yaml:"enabled"`
+	// host:port of the OTLP/HTTP collector
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	// fraction of the traces started by gorvp to sample, 0 means all of them
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type ListenerDocument struct {
+	Address string      `yaml:"address"`
+	TLS     TLSDocument `yaml:"tls"`
+	// hosts served by the listener, "*.example.com" is allowed, empty for any host
+	Hosts   []string    `yaml:"hosts"`
+}
+
+type TLSDocument struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// listener names of each component, a component without names is served on every
+// listener, except admin, connections and metrics which are not served then
+type BindDocument struct {
+	Admin       []string `yaml:"admin"`
+	Connections []string `yaml:"connections"`
+	OAuth2      []string `yaml:"oauth2"`
+	Metrics     []string `yaml:"metrics"`
+	Frontend    []string `yaml:"frontend"`
+	Custom      []string `yaml:"custom"`
+}
+
+// error template files by status code ("404"), status class ("5xx") or "default"
+type ErrorPageDocument struct {
+	HTML map[string]string `yaml:"html"`
+	JSON map[string]string `yaml:"json"`
 }
 
 type TrustedClient struct {
@@ -47,8 +152,12 @@ type TrustedClient struct {
 	Secret           string `yaml:"secret"`
 	SharedKey        string `yaml:"shared_key"`
 	IdentityEndpoint string `yaml:"identity_endpoint"`
+	// optional, claims of the users for the openid connect userinfo endpoint
+	UserInfoEndpoint string `yaml:"userinfo_endpoint"`
 	TokenMountPoint  string `yaml:"token_mount_point"`
 	Default_provider bool   `yaml:"default_provider"`
+	// listeners serving the token mount point, the ones of oauth2 if empty
+	Listeners        []string `yaml:"listeners"`
 }
 
 type Config struct {
@@ -56,19 +165,50 @@ type Config struct {
 	Port                  string
 	PidFile               string
 	Issuer                string           `yaml:"issuer"`
+	Server                ServerDocument   `yaml:"server"`
 	Lifespan              LifespanConf     `yaml:"lifespan"`
 	Frontend              FrontDocument    `yaml:"frontend"`
 	Database              DatabaseDocument `yaml:"database"`
 	RsaKey                RsaKeyDocument   `yaml:"rsa_key"`
+	Keyring               KeyringDocument  `yaml:"keyring"`
 	Oauth2AuthMountPoint  string           `yaml:"oauth2_auth_mount_point"`
 	Oauth2TokenMountPoint string           `yaml:"oauth2_token_mount_point"`
+	Oauth2IntrospectMountPoint string      `yaml:"oauth2_introspect_mount_point"`
+	Oauth2RevokeMountPoint string          `yaml:"oauth2_revoke_mount_point"`
+	UserInfoMountPoint    string           `yaml:"userinfo_mount_point"`
+	// url the trusted clients reach the token endpoint on, "http://127.0.0.1:8081",
+	// needed if every oauth2 listener has tls
+	Oauth2InternalURL     string           `yaml:"oauth2_internal_url"`
+	// device authorization grant, mounted with the login pages
+	Oauth2DeviceAuthorizationMountPoint string `yaml:"oauth2_device_authorization_mount_point"`
+	DeviceVerificationMountPoint string    `yaml:"device_verification_mount_point"`
+	// every public client needs a PKCE code challenge for the authorization code grant
+	RequirePKCE           bool             `yaml:"require_pkce"`
+	Login                 LoginDocument    `yaml:"login"`
 	TrustedClients        []TrustedClient  `yaml:"trusted_clients"`
+	TrustedProxies        ConfigCIDRs      `yaml:"trusted_proxies"`
+	ErrorPages            map[string]ErrorPageDocument `yaml:"error_pages"`
+	AccessLog             AccessLogDocument `yaml:"access_log"`
+	Metrics               MetricsDocument  `yaml:"metrics"`
+	Tracing               TracingDocument  `yaml:"tracing"`
+	Listeners             map[string]ListenerDocument `yaml:"listeners"`
+	Bind                  BindDocument     `yaml:"bind"`
+	trustedProxies        []*net.IPNet
 }
 
 type Frontend struct {
-	Backend string       `yaml:"backend"`
-	Plugins []string     `yaml:"plugins"`
-	Scopes  ConfigScopes `yaml:"scopes"`
+	Backend       string       `yaml:"backend"`
+	Plugins       []string     `yaml:"plugins"`
+	Scopes        ConfigScopes `yaml:"scopes"`
+	// byte, only tightens the global server.max_body_size
+	MaxBodySize   int64        `yaml:"max_body_size"`
+	BufferRequest bool         `yaml:"buffer_request"`
+	Allow         ConfigCIDRs  `yaml:"allow"`
+	Deny          ConfigCIDRs  `yaml:"deny"`
+	// send the host of the backend instead of the Host requested by the client
+	RewriteHost   bool         `yaml:"rewrite_host"`
+	// do not replace 5xx responses of the backend with the error page
+	PassBackendErrors bool     `yaml:"pass_backend_errors"`
 }
 
 type ConfigScopes []string
@@ -90,10 +230,121 @@ func (c *Config) Load() (err error) {
 	if err != nil {
 		return errors.New("error when parse the file.")
 	}
-	c.GenerateRsaKeyIfNotExist()
+	if c.Oauth2IntrospectMountPoint == "" {
+		c.Oauth2IntrospectMountPoint = "/oauth/introspect"
+	}
+	if c.Oauth2RevokeMountPoint == "" {
+		c.Oauth2RevokeMountPoint = "/oauth/revoke"
+	}
+	if c.Keyring.Path == "" {
+		c.Keyring.Path = filepath.Join(filepath.Dir(c.RsaKey.Token.Private), "keyring.json")
+	}
+	if c.UserInfoMountPoint == "" {
+		c.UserInfoMountPoint = "/userinfo"
+	}
+	if c.Login.MountPoint == "" {
+		c.Login.MountPoint = "/oauth/login"
+	}
+	if c.Login.Lifespan == 0 {
+		c.Login.Lifespan = 3600
+	}
+	if c.Oauth2DeviceAuthorizationMountPoint == "" {
+		c.Oauth2DeviceAuthorizationMountPoint = "/oauth/device_authorization"
+	}
+	if c.DeviceVerificationMountPoint == "" {
+		c.DeviceVerificationMountPoint = "/oauth/device"
+	}
+	if c.Lifespan.DeviceCode == 0 {
+		c.Lifespan.DeviceCode = 600
+	}
+	err = c.parseCIDRs()
+	if err != nil {
+		return err
+	}
+	err = c.checkBind()
+	if err != nil {
+		return err
+	}
+	return c.GenerateRsaKeyIfNotExist()
+}
+
+func (c *Config) parseCIDRs() (err error) {
+	c.trustedProxies, err = c.TrustedProxies.Parse()
+	if err != nil {
+		return errors.Errorf("trusted_proxies: %s", err)
+	}
+	for hostname, frontend := range c.Frontend {
+		for path, frontendConfig := range frontend {
+			_, err = NewIPFilter(frontendConfig.Allow, frontendConfig.Deny)
+			if err != nil {
+				return errors.Errorf("frontend %s%s: %s", hostname, path, err)
+			}
+		}
+	}
 	return nil
 }
 
+func (c *Config) checkBind() error {
+	bind := map[string][]string{
+		ComponentAdmin:       c.Bind.Admin,
+		ComponentConnections: c.Bind.Connections,
+		ComponentOAuth2:      c.Bind.OAuth2,
+		ComponentMetrics:     c.Bind.Metrics,
+		ComponentFrontend:    c.Bind.Frontend,
+		ComponentCustom:      c.Bind.Custom,
+	}
+	for _, trustedClient := range c.TrustedClients {
+		bind["trusted client " + trustedClient.Name] = trustedClient.Listeners
+	}
+	for component, names := range bind {
+		for _, name := range names {
+			if _, ok := c.Listeners[name]; !ok {
+				return errors.Errorf("bind %s: listener %s is not defined", component, name)
+			}
+		}
+	}
+
+	// the trusted clients call the token endpoint on 127.0.0.1, which does not
+	// match the certificate of a tls listener
+	if len(c.Listeners) == 0 || len(c.TrustedClients) == 0 || c.Oauth2InternalURL != "" {
+		return nil
+	}
+	oauth2 := c.Bind.OAuth2
+	if len(oauth2) == 0 {
+		for name := range c.Listeners {
+			oauth2 = append(oauth2, name)
+		}
+	}
+	for _, name := range oauth2 {
+		if c.Listeners[name].TLS.Cert == "" {
+			return nil
+		}
+	}
+	return errors.New("oauth2_internal_url is required if every oauth2 listener has tls")
+}
+
+func (b *BindDocument) For(component string) []string {
+	switch component {
+	case ComponentAdmin:
+		return b.Admin
+	case ComponentConnections:
+		return b.Connections
+	case ComponentOAuth2:
+		return b.OAuth2
+	case ComponentMetrics:
+		return b.Metrics
+	case ComponentFrontend:
+		return b.Frontend
+	case ComponentCustom:
+		return b.Custom
+	}
+	return nil
+}
+
+func (c *Config) GetTrustedProxies() []*net.IPNet {
+	return c.trustedProxies
+}
+
 func (config *Config) SetupRoute(router *mux.Router, m *negroni.Negroni) {
 	for _, frontend := range config.Frontend {
 		for path, _ := range frontend {
@@ -102,73 +353,50 @@ func (config *Config) SetupRoute(router *mux.Router, m *negroni.Negroni) {
 	}
 }
 
-func (c *Config) GenerateRsaKeyIfNotExist() {
-	generateRsaKeyIfNotExist(&c.RsaKey.Token)
+func (c *Config) GenerateRsaKeyIfNotExist() error {
+	err := loadOrGenerateKey(&c.RsaKey.Token, c.Keyring.Algorithm, c.Keyring.RSABits)
+	if err != nil {
+		return errors.Errorf("rsa_key.token: %s", err)
+	}
+	return nil
 }
 
-func generateRsaKeyIfNotExist(rsaKey *RsaKey) {
-	if _, err := os.Stat(rsaKey.Private); err != nil {
-		if os.IsNotExist(err) {
-			debug("generate new rsa key")
-			key, err := rsa.GenerateKey(rand.Reader, 1152)
-			if err != nil {
-				panic(err)
-			}
-			// save RSA key
-			rsaKey.Key = key
-			priBytes := pem.EncodeToMemory(&pem.Block{
-				Type: "RSA PRIVATE KEY",
-				Bytes: x509.MarshalPKCS1PrivateKey(key),
-			})
-			os.MkdirAll(filepath.Dir(rsaKey.Private), 0755)
-			err = ioutil.WriteFile(rsaKey.Private, priBytes, 0600)
-			if err != nil {
-				log.Fatalf("can not write private key: %s", err)
-				panic(err)
-			}
-
-			// save RSA public key
-			pubASN1, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
-			pubBytes := pem.EncodeToMemory(&pem.Block{
-				Type: "RSA PUBLIC KEY",
-				Bytes: pubASN1,
-			})
-			os.MkdirAll(filepath.Dir(rsaKey.Public), 0755)
-			err = ioutil.WriteFile(rsaKey.Public, pubBytes, 0644)
-			if err != nil {
-				log.Fatalf("can not write public key: %s", err)
-				panic(err)
-			}
-			return
-		}
-		panic(err)
+// loadOrGenerateKey reads the private key of rsaKey, a new key of algorithm
+// is generated and written if the file does not exist.
+func loadOrGenerateKey(rsaKey *RsaKey, algorithm string, bits int) error {
+	pemData, err := ioutil.ReadFile(rsaKey.Private)
+	if err == nil {
+		rsaKey.Key, err = ParsePrivateKey(pemData, rsaKey.Passphrase)
+		return err
+	}
+	if !os.IsNotExist(err) {
+		return errors.Errorf("can not read key file: %s", err)
 	}
 
-	// file exists, read the private key
-	pemData, err := ioutil.ReadFile(rsaKey.Private)
+	debug("generate new %s key", algorithm)
+	key, err := GenerateKey(algorithm, bits)
 	if err != nil {
-		log.Fatalf("can not read key file: %s", err)
-		if (os.IsNotExist(err)) {
-		}
-		panic(err)
+		return err
 	}
-
-	// extract the PEM-encoded data block
-	pemBlock, _ := pem.Decode(pemData)
-	if pemBlock == nil {
-		log.Fatalf("bad key data: %s", "not PEM-encoded")
-		panic(err)
+	priBytes, err := MarshalPrivateKey(key)
+	if err != nil {
+		return err
 	}
-	if got, want := pemBlock.Type, "RSA PRIVATE KEY"; got != want {
-		log.Fatalf("unknown key type %q, want %q", got, want)
-		panic(err)
+	os.MkdirAll(filepath.Dir(rsaKey.Private), 0755)
+	err = ioutil.WriteFile(rsaKey.Private, priBytes, 0600)
+	if err != nil {
+		return errors.Errorf("can not write private key: %s", err)
 	}
 
-	// decode the RSA private key
-	key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	pubBytes, err := MarshalPublicKey(key)
 	if err != nil {
-		log.Fatalf("bad private key: %s", err)
-		panic(err)
+		return err
+	}
+	os.MkdirAll(filepath.Dir(rsaKey.Public), 0755)
+	err = ioutil.WriteFile(rsaKey.Public, pubBytes, 0644)
+	if err != nil {
+		return errors.Errorf("can not write public key: %s", err)
 	}
 	rsaKey.Key = key
+	return nil
 }
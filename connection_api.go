@@ -21,14 +21,14 @@ type ConnectionResponse struct {
 func (h *ConnectionHandler) GetApplications(w http.ResponseWriter, r *http.Request) {
 	claims, _, err := GetTokenClaimsFromBearer(h.Store, r)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	connection := &Connection{UserID: claims.Subject}
 	connections := []Connection{}
 	err = h.Store.DB.Preload("Client").Where(connection).Find(&connections).Error
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -64,7 +64,7 @@ func (h *ConnectionHandler) GetApplications(w http.ResponseWriter, r *http.Reque
 func (h *ConnectionHandler) RevokeApplication(w http.ResponseWriter, r *http.Request) {
 	claims, _, err := GetTokenClaimsFromBearer(h.Store, r)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
@@ -73,20 +73,20 @@ func (h *ConnectionHandler) RevokeApplication(w http.ResponseWriter, r *http.Req
 	err = h.Store.DB.Find(connection).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			WriteError(w, ErrRecordNotFound)
+			WriteRequestError(w, r, ErrRecordNotFound)
 			return
 		}
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	if connection.UserID != claims.Subject {
-		WriteError(w, ErrPermissionDenied)
+		WriteRequestError(w, r, ErrPermissionDenied)
 		return
 	}
 
 	err = h.Store.DB.Delete(connection).Error
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
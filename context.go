@@ -0,0 +1,13 @@
+package gorvp
+
+// contextKey is the type of the values gorvp attaches to the request context.
+type contextKey int
+
+const (
+	forwardedKey contextKey = iota
+	errorPagesKey
+	accessLogKey
+	metricsKey
+	requestIDKey
+	connKey
+)
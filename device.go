@@ -0,0 +1,292 @@
+package gorvp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
+	"github.com/ory-am/fosite"
+	"github.com/pborman/uuid"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// seconds a device waits between two polls of the token endpoint
+const deviceCodeInterval = 5
+
+// user codes are 8 consonants, without vowels so they never spell a word
+// (RFC 8628 section 6.1)
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+// DeviceAuthorizationResponse is the response of the device authorization endpoint.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DevicePageData is passed to the device template. Step is "code" while the
+// user enters the user code, "confirm" for the consent and "done" at last.
+type DevicePageData struct {
+	Action     string
+	CSRFToken  string
+	Step       string
+	UserCode   string
+	ClientName string
+	Subject    string
+	Scopes     []ConsentScope
+	Approved   bool
+	Error      string
+}
+
+// deviceFlowEnabled reports whether the device authorization grant is served,
+// the user approves the devices on the verification page, which needs the login.
+func (goRvp *GoRvp) deviceFlowEnabled() bool {
+	return goRvp.loginPages != nil
+}
+
+// deviceAuthorizationEndpoint issues the device and user codes (RFC 8628 section 3.1).
+func (goRvp *GoRvp) deviceAuthorizationEndpoint(tokenHandler *TokenHandler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		client, err := tokenHandler.authenticateClient(req, true)
+		if err != nil {
+			WriteRequestError(rw, req, err)
+			return
+		}
+		if entry := GetAccessLogEntry(req); entry != nil {
+			entry.ClientID = client.GetID()
+		}
+		if !client.GetGrantTypes().Has(gorvpOauth2.GrantTypeDeviceCode) {
+			WriteRequestError(rw, req, ErrClientPermission)
+			return
+		}
+		var scopes []string
+		for _, scope := range strings.Fields(req.PostForm.Get("scope")) {
+			if !fosite.HierarchicScopeStrategy(client.GetScopes(), scope) {
+				WriteRequestError(rw, req, ErrClientPermission)
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+
+		deviceCode, err := newDeviceCode()
+		if err != nil {
+			WriteRequestError(rw, req, ErrServerError)
+			return
+		}
+		userCode, err := newUserCode()
+		if err != nil {
+			WriteRequestError(rw, req, ErrServerError)
+			return
+		}
+		lifespan := goRvp.Config.Lifespan.DeviceCode * time.Second
+		err = goRvp.store.CreateDeviceCode(deviceCode, &DeviceCode{
+			UserCode:    userCode,
+			ClientID:    client.GetID(),
+			ScopeString: strings.Join(scopes, " "),
+			Interval:    deviceCodeInterval,
+			ExpiresAt:   time.Now().Add(lifespan),
+		})
+		if err != nil {
+			WriteRequestError(rw, req, err)
+			return
+		}
+
+		verificationURI := strings.TrimSuffix(goRvp.Config.Issuer, "/") + goRvp.Config.DeviceVerificationMountPoint
+		rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		rw.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(rw).Encode(&DeviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                formatUserCode(userCode),
+			VerificationURI:         verificationURI,
+			VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+			ExpiresIn:               int64(lifespan / time.Second),
+			Interval:                deviceCodeInterval,
+		})
+	}
+}
+
+// deviceVerificationEndpoint is the page the user enters the user code on
+// and approves the request of the device, once logged in.
+func (goRvp *GoRvp) deviceVerificationEndpoint(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	loginSession := goRvp.loginSessionOf(req)
+	if loginSession == nil {
+		goRvp.redirectToLogin(rw, req)
+		return
+	}
+	data := &DevicePageData{
+		Action:    goRvp.Config.DeviceVerificationMountPoint,
+		CSRFToken: csrfTokenOf(rw, req),
+		Step:      "code",
+		UserCode:  req.Form.Get("user_code"),
+		Subject:   loginSession.Subject,
+	}
+	if req.Method != http.MethodPost {
+		goRvp.loginPages.render(rw, goRvp.loginPages.Device, http.StatusOK, data)
+		return
+	}
+	if !validCSRFToken(req) {
+		WriteRequestError(rw, req, ErrInvalidRequest)
+		return
+	}
+
+	record, err := goRvp.store.GetPendingDeviceCode(normalizeUserCode(data.UserCode))
+	if err != nil {
+		data.Error = "The code is wrong or expired."
+		goRvp.loginPages.render(rw, goRvp.loginPages.Device, http.StatusBadRequest, data)
+		return
+	}
+	client, err := goRvp.store.GetRvpClient(record.ClientID)
+	if err != nil {
+		WriteRequestError(rw, req, ErrInvalidClient)
+		return
+	}
+	requested := strings.Fields(record.ScopeString)
+	data.ClientName = client.GetName()
+	data.Scopes = goRvp.consentScopes(client, requested, nil)
+
+	switch req.PostForm.Get("consent") {
+	case "":
+		data.Step = "confirm"
+		goRvp.loginPages.render(rw, goRvp.loginPages.Device, http.StatusOK, data)
+		return
+	case "allow":
+		choice := chosenScopes(req, data.Scopes)
+		var granted []string
+		for _, name := range requested {
+			if choice[name] || name == ScopeOpenID {
+				granted = append(granted, name)
+			}
+		}
+		connection, err := goRvp.store.UpdateConnection(client.GetID(), loginSession.Subject, granted)
+		if err != nil {
+			WriteRequestError(rw, req, ErrServerError)
+			return
+		}
+		request := &fosite.Request{
+			ID:            uuid.New(),
+			RequestedAt:   time.Now(),
+			Client:        client,
+			Scopes:        requested,
+			GrantedScopes: granted,
+			Form:          url.Values{},
+			Session:       NewSession(goRvp.Config, loginSession.Subject, granted, client.GetID(), connection),
+		}
+		err = goRvp.store.DecideDeviceCode(record, loginSession.Subject, request)
+		data.Approved = true
+	default:
+		err = goRvp.store.DecideDeviceCode(record, loginSession.Subject, nil)
+	}
+	if err != nil {
+		WriteRequestError(rw, req, err)
+		return
+	}
+	if entry := GetAccessLogEntry(req); entry != nil {
+		entry.Subject = loginSession.Subject
+		entry.ClientID = client.GetID()
+	}
+	data.Step = "done"
+	goRvp.loginPages.render(rw, goRvp.loginPages.Device, http.StatusOK, data)
+}
+
+// writeDeviceError writes the errors of the device access token request,
+// false if err is none of them.
+func writeDeviceError(rw http.ResponseWriter, err error) bool {
+	deviceErr, ok := pkgerrors.Cause(err).(*gorvpOauth2.DeviceError)
+	if !ok {
+		return false
+	}
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(rw).Encode(map[string]string{
+		"error":             deviceErr.Name,
+		"error_description": deviceErr.Description,
+	})
+	return true
+}
+
+func newDeviceCode() (string, error) {
+	r := make([]byte, 32)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(r), nil
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeCharset)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits the user code in two halves, "BDFH-JKLM".
+func formatUserCode(userCode string) string {
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// normalizeUserCode drops the dash and the spaces the user may have typed.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, userCode)
+}
+
+const defaultDeviceTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+{{if eq .Step "code"}}
+<h1>Connect a device</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<p><label>Code shown on the device <input type="text" name="user_code" value="{{.UserCode}}" autofocus required></label></p>
+<p><button type="submit">Continue</button></p>
+</form>
+{{else if eq .Step "confirm"}}
+<h1>{{.ClientName}} asks for access to your account</h1>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<ul>
+{{range .Scopes}}<li><label>
+<input type="checkbox" name="scope_choice" value="{{.Name}}" checked{{if .Required}} disabled{{end}}>
+<strong>{{.DisplayName}}</strong>{{if .Required}} (required){{end}}
+{{if .Description}}<br>{{.Description}}{{end}}
+</label></li>
+{{end}}</ul>
+<p>Signed in as {{.Subject}}</p>
+<p>
+<button type="submit" name="consent" value="allow">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</p>
+</form>
+{{else}}
+<h1>{{if .Approved}}The device is connected{{else}}The request is denied{{end}}</h1>
+<p>You can return to your device.</p>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,218 @@
+package gorvp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/go-errors/errors"
+)
+
+type errorTemplate interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
+// ErrorTemplates holds the error templates of a host, keyed by status code
+// ("404"), status class ("5xx") or "default".
+type ErrorTemplates struct {
+	HTML map[string]errorTemplate
+	JSON map[string]errorTemplate
+}
+
+// ErrorPages maps a hostname to its error templates, hostnames are matched
+// like frontends, including "*.example.com" and "*".
+type ErrorPages map[string]*ErrorTemplates
+
+// ErrorPageData is passed to the error templates.
+type ErrorPageData struct {
+	*GoRvpError
+	StatusText string
+	Host       string
+	Path       string
+}
+
+var errorTemplateFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func NewErrorPages(config *Config) (ErrorPages, error) {
+	pages := make(ErrorPages)
+	for hostname, document := range config.ErrorPages {
+		templates := &ErrorTemplates{
+			HTML: make(map[string]errorTemplate),
+			JSON: make(map[string]errorTemplate),
+		}
+		for status, path := range document.HTML {
+			t, err := htmltemplate.New(filepath.Base(path)).Funcs(errorTemplateFuncs).ParseFiles(path)
+			if err != nil {
+				return nil, errors.Errorf("error_pages %s html %s: %s", hostname, status, err)
+			}
+			templates.HTML[strings.ToLower(status)] = t
+		}
+		for status, path := range document.JSON {
+			t, err := texttemplate.New(filepath.Base(path)).Funcs(errorTemplateFuncs).ParseFiles(path)
+			if err != nil {
+				return nil, errors.Errorf("error_pages %s json %s: %s", hostname, status, err)
+			}
+			templates.JSON[strings.ToLower(status)] = t
+		}
+		pages[hostname] = templates
+	}
+	return pages, nil
+}
+
+// ServeHTTP attaches the error templates of the requested host to the request context.
+func (pages ErrorPages) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	templates := pages.match(r.Host)
+	if templates == nil {
+		next(rw, r)
+		return
+	}
+	next(rw, r.WithContext(context.WithValue(r.Context(), errorPagesKey, templates)))
+}
+
+func (pages ErrorPages) match(host string) *ErrorTemplates {
+	hostname := hostnameOf(host)
+	if templates, ok := pages[hostname]; ok {
+		return templates
+	}
+	if templates, ok := pages[wildcardOf(hostname)]; ok {
+		return templates
+	}
+	return pages["*"]
+}
+
+func getErrorTemplates(r *http.Request) *ErrorTemplates {
+	if r == nil {
+		return nil
+	}
+	templates, _ := r.Context().Value(errorPagesKey).(*ErrorTemplates)
+	return templates
+}
+
+// lookup returns the template for the status code and the content type the
+// client accepts, browsers get html and everyone else json.
+func (t *ErrorTemplates) lookup(r *http.Request, statusCode int) (errorTemplate, string) {
+	templates, contentType := t.JSON, "application/json"
+	if acceptsHTML(r) {
+		templates, contentType = t.HTML, "text/html; charset=utf-8"
+	}
+	status := strconv.Itoa(statusCode)
+	for _, key := range []string{status, status[:1] + "xx", "default"} {
+		if tmpl, ok := templates[key]; ok {
+			return tmpl, contentType
+		}
+	}
+	return nil, ""
+}
+
+// render writes the error page, false if there is no template for it.
+func (t *ErrorTemplates) render(rw http.ResponseWriter, r *http.Request, goRvpErr *GoRvpError) bool {
+	tmpl, contentType := t.lookup(r, goRvpErr.StatusCode)
+	if tmpl == nil {
+		return false
+	}
+	data := &ErrorPageData{
+		GoRvpError: goRvpErr,
+		StatusText: http.StatusText(goRvpErr.StatusCode),
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+	body := &bytes.Buffer{}
+	if err := tmpl.Execute(body, data); err != nil {
+		debug("can not render error page: %s", err)
+		return false
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	rw.WriteHeader(goRvpErr.StatusCode)
+	rw.Write(body.Bytes())
+	return true
+}
+
+func acceptsHTML(r *http.Request) bool {
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(mediaRange, ";")[0])
+		switch mediaType {
+		case "application/json":
+			return false
+		case "text/html", "application/xhtml+xml":
+			return true
+		}
+	}
+	return false
+}
+
+// BackendErrorServer replaces 5xx responses of a backend with the error page of the host.
+type BackendErrorServer struct {
+	handler http.Handler
+}
+
+func newBackendErrorServer(handler http.Handler) http.Handler {
+	return &BackendErrorServer{handler}
+}
+
+func (server *BackendErrorServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	templates := getErrorTemplates(request)
+	if templates == nil {
+		server.handler.ServeHTTP(writer, request)
+		return
+	}
+	server.handler.ServeHTTP(&BackendErrorWriter{
+		ResponseWriter: writer,
+		request:        request,
+		templates:      templates,
+	}, request)
+}
+
+type BackendErrorWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	templates   *ErrorTemplates
+	intercepted bool
+}
+
+func (w *BackendErrorWriter) WriteHeader(n int) {
+	if n >= http.StatusInternalServerError {
+		if tmpl, _ := w.templates.lookup(w.request, n); tmpl != nil {
+			debug("Serving error page for backend status %d.", n)
+			header := w.ResponseWriter.Header()
+			header.Del("Content-Encoding")
+			header.Del("Content-Length")
+			w.intercepted = w.templates.render(w.ResponseWriter, w.request, &GoRvpError{
+				Type:        "backend_error",
+				Description: http.StatusText(n),
+				StatusCode:  n,
+				RequestID:   GetRequestID(w.request),
+			})
+			if w.intercepted {
+				return
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(n)
+}
+
+func (w *BackendErrorWriter) Write(b []byte) (int, error) {
+	if w.intercepted {
+		// drop the body of the backend
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack of the
+// underlying writer, used for streaming and websocket.
+func (w *BackendErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -24,12 +24,18 @@ var (
 	ErrModAppTypeNotAllowed = errors.New("Change app type is not allowed, please create new client instead")
 	ErrClientNotFound = errors.New("Unknown client, make sure the client is registed")
 	ErrServerError = errors.New("The authorization server encountered an unexpected condition that prevented it from fulfilling the request")
+	ErrRequestEntityTooLarge = errors.New("The request body is larger than the server is willing to process")
+	ErrIPNotAllowed = errors.New("The request is not allowed from this IP address")
+	ErrRouteNotFound = errors.New("The requested resource could not be found")
+	ErrKeyNotFound = errors.New("Signing key not found")
+	ErrRetireSigningKey = errors.New("The key signing the tokens can not be retired, rotate first")
 )
 
 type GoRvpError struct {
 	Type        string `json:"error_type"`
 	Description string `json:"error_description"`
 	StatusCode  int    `json:"status_code"`
+	RequestID   string `json:"request_id,omitempty"`
 }
 
 func ErrorToHttpResponse(err error) *GoRvpError {
@@ -136,6 +142,36 @@ func ErrorToHttpResponse(err error) *GoRvpError {
 			Description: ErrServerError.Error(),
 			StatusCode:  http.StatusInternalServerError,
 		}
+	case ErrRequestEntityTooLarge:
+		return &GoRvpError{
+			Type:        "request_entity_too_large",
+			Description: ErrRequestEntityTooLarge.Error(),
+			StatusCode:  http.StatusRequestEntityTooLarge,
+		}
+	case ErrIPNotAllowed:
+		return &GoRvpError{
+			Type:        "ip_not_allowed",
+			Description: ErrIPNotAllowed.Error(),
+			StatusCode:  http.StatusForbidden,
+		}
+	case ErrRouteNotFound:
+		return &GoRvpError{
+			Type:        "not_found",
+			Description: ErrRouteNotFound.Error(),
+			StatusCode:  http.StatusNotFound,
+		}
+	case ErrKeyNotFound:
+		return &GoRvpError{
+			Type:        "not_found",
+			Description: ErrKeyNotFound.Error(),
+			StatusCode:  http.StatusNotFound,
+		}
+	case ErrRetireSigningKey:
+		return &GoRvpError{
+			Type:        "invalid_request",
+			Description: ErrRetireSigningKey.Error(),
+			StatusCode:  http.StatusConflict,
+		}
 	default:
 		return &GoRvpError{
 			Type:        "unknown_error",
@@ -145,8 +181,20 @@ func ErrorToHttpResponse(err error) *GoRvpError {
 	}
 }
 
+// WriteError writes err as json.
 func WriteError(rw http.ResponseWriter, err error) {
+	WriteRequestError(rw, nil, err)
+}
+
+// WriteRequestError writes err of request r as json, or with the error template
+// of the requested host if there is one.
+func WriteRequestError(rw http.ResponseWriter, r *http.Request, err error) {
 	goRvpErr := ErrorToHttpResponse(err)
+	goRvpErr.RequestID = GetRequestID(r)
+	getMetrics(r).AuthorizationFailure(goRvpErr)
+	if templates := getErrorTemplates(r); templates != nil && templates.render(rw, r, goRvpErr) {
+		return
+	}
 
 	json, err := json.MarshalIndent(goRvpErr, "", "\t")
 	if err != nil {
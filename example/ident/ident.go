@@ -12,6 +12,13 @@ var UserTable = map[string]string{
 	"peter": "foobar",
 }
 
+var ClaimsTable = map[string]map[string]interface{}{
+	"peter": {
+		"name":  "Peter",
+		"email": "peter@example.com",
+	},
+}
+
 type IdentityProvider struct {
 	SharedSecret []byte
 }
@@ -42,6 +49,43 @@ func (ip *IdentityProvider) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	rw.WriteHeader(http.StatusNotFound)
 }
 
+// UserInfo returns the claims of the user, encrypted with the shared secret.
+func (ip *IdentityProvider) UserInfo(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	encryption, err := jose.ParseEncrypted(string(body))
+	if checkErr(rw, err) {
+		return
+	}
+	decrypted, err := encryption.Decrypt(ip.SharedSecret)
+	if checkErr(rw, err) {
+		return
+	}
+	ur := &gorvp.UserInfoRequest{}
+	err = json.Unmarshal(decrypted, ur)
+	if checkErr(rw, err) {
+		return
+	}
+	claims, ok := ClaimsTable[ur.Subject]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	claimsJSON, _ := json.Marshal(claims)
+	encrypter, err := jose.NewEncrypter(jose.DIRECT, jose.A256GCM, ip.SharedSecret)
+	if checkErr(rw, err) {
+		return
+	}
+	encrypted, err := encrypter.Encrypt(claimsJSON)
+	if checkErr(rw, err) {
+		return
+	}
+	rw.Write([]byte(encrypted.FullSerialize()))
+}
+
 func checkErr(rw http.ResponseWriter, err error) (bool) {
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -5,9 +5,12 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/urfave/cli"
 	"os"
+	"fmt"
+	"time"
 	"github.com/jacyzon/gorvp/example/ident"
 	"github.com/jacyzon/gorvp"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 func main() {
@@ -47,7 +50,87 @@ func main() {
 			SharedSecret: []byte("a1z5iJ0o4MN8UnbLBJwTGH1NxVZYW8EO"),
 		}
 		router.HandleFunc("/ident", identityProvider.ServeHTTP)
+		router.HandleFunc("/ident/userinfo", identityProvider.UserInfo)
 		return goRvp.Run()
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "keys",
+			Usage: "manage the token signing keys",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list the signing keys",
+					Action: func(c *cli.Context) error {
+						keyring, err := loadKeyring(config)
+						if err != nil {
+							return err
+						}
+						printKeys(keyring)
+						return nil
+					},
+				},
+				{
+					Name:  "rotate",
+					Usage: "activate the next signing key",
+					Action: func(c *cli.Context) error {
+						keyring, err := loadKeyring(config)
+						if err != nil {
+							return err
+						}
+						if _, err := keyring.Rotate(); err != nil {
+							return err
+						}
+						printKeys(keyring)
+						return nil
+					},
+				},
+				{
+					Name:      "retire",
+					Usage:     "stop validating the tokens signed with a key",
+					ArgsUsage: "<kid>",
+					Action: func(c *cli.Context) error {
+						keyring, err := loadKeyring(config)
+						if err != nil {
+							return err
+						}
+						if err := keyring.Retire(c.Args().First()); err != nil {
+							return err
+						}
+						printKeys(keyring)
+						return nil
+					},
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
+
+// loadKeyring opens the keyring of the config, the running servers load the
+// changes within a minute.
+func loadKeyring(config *gorvp.Config) (*gorvp.Keyring, error) {
+	if err := config.Load(); err != nil {
+		return nil, err
+	}
+	if config.Keyring.Storage != gorvp.KeyringStorageDatabase {
+		return gorvp.LoadKeyring(config.Keyring, config.RsaKey.Token.Key, nil)
+	}
+	db, err := gorm.Open(config.Database.Type, config.Database.Connection)
+	if err != nil {
+		return nil, err
+	}
+	store := &gorvp.Store{DB: db}
+	store.Migrate()
+	return gorvp.LoadKeyring(config.Keyring, config.RsaKey.Token.Key, db)
+}
+
+func printKeys(keyring *gorvp.Keyring) {
+	for _, key := range gorvp.NewSigningKeyResponses(keyring) {
+		signing := ""
+		if key.Signing {
+			signing = "signing"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", key.ID, key.State, key.CreatedAt.Format(time.RFC3339), signing)
+	}
+}
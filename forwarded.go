@@ -0,0 +1,142 @@
+package gorvp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedInfo is what gorvp knows about the original request, after
+// X-Forwarded-* headers from trusted proxies are taken into account.
+type ForwardedInfo struct {
+	// ClientIP is the real address of the client
+	ClientIP net.IP
+	// Proto and Host are the scheme and host requested by the client
+	Proto string
+	Host  string
+	// TrustedPeer is true if the request came from a trusted proxy,
+	// in this case the forwarding headers are kept and appended
+	TrustedPeer bool
+}
+
+// Forwarded is a negroni middleware which resolves the ForwardedInfo of
+// every request and attaches it to the request context.
+type Forwarded struct {
+	TrustedProxies []*net.IPNet
+}
+
+func NewForwarded(trustedProxies []*net.IPNet) *Forwarded {
+	return &Forwarded{TrustedProxies: trustedProxies}
+}
+
+func (f *Forwarded) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	info := NewForwardedInfo(r, f.TrustedProxies)
+	next(rw, r.WithContext(context.WithValue(r.Context(), forwardedKey, info)))
+}
+
+func NewForwardedInfo(r *http.Request, trustedProxies []*net.IPNet) *ForwardedInfo {
+	info := &ForwardedInfo{
+		ClientIP: ClientIP(r, trustedProxies),
+		Proto:    "http",
+		Host:     r.Host,
+	}
+	if r.TLS != nil {
+		info.Proto = "https"
+	}
+
+	peer := parseHostIP(r.RemoteAddr)
+	if peer != nil && containsIP(trustedProxies, peer) {
+		info.TrustedPeer = true
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+			info.Proto = strings.ToLower(proto)
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			info.Host = host
+		}
+	}
+	return info
+}
+
+// GetForwardedInfo returns the ForwardedInfo attached by Forwarded,
+// or derives one without any trusted proxy.
+func GetForwardedInfo(r *http.Request) *ForwardedInfo {
+	if info, ok := r.Context().Value(forwardedKey).(*ForwardedInfo); ok {
+		return info
+	}
+	return NewForwardedInfo(r, nil)
+}
+
+// RealIP returns the address of the client which sent the request.
+func RealIP(r *http.Request) net.IP {
+	return GetForwardedInfo(r).ClientIP
+}
+
+// ClientIP returns the address of the client which sent the request.
+// X-Forwarded-For is only honored when the peer is a trusted proxy, the
+// addresses are walked from right to left and the first one that is not a
+// trusted proxy is the client.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	ip := parseHostIP(r.RemoteAddr)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// setForwardedHeaders is called by the director of the reverse proxy.
+// X-Forwarded-For itself is appended by httputil.ReverseProxy.
+func setForwardedHeaders(req *http.Request, info *ForwardedInfo) {
+	if !info.TrustedPeer {
+		// the headers are set by the client itself, they can not be trusted
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("Forwarded")
+	}
+	req.Header.Set("X-Forwarded-Proto", info.Proto)
+	req.Header.Set("X-Forwarded-Host", info.Host)
+
+	// RFC 7239 section 5.2, the node gorvp received the request from, the
+	// client is in the elements of the trusted proxies before
+	element := "for=" + forwardedNode(parseHostIP(req.RemoteAddr)) +
+		";host=" + quoteForwarded(info.Host) +
+		";proto=" + info.Proto
+	if prior := strings.Join(req.Header["Forwarded"], ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return "\"[" + ip.String() + "]\""
+	}
+	return ip.String()
+}
+
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" ,;=") {
+		return "\"" + strings.Replace(value, "\"", "\\\"", -1) + "\""
+	}
+	return value
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
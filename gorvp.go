@@ -1,7 +1,6 @@
 package gorvp
 
 import (
-	"fmt"
 	"time"
 	"os"
 	"io/ioutil"
@@ -10,145 +9,470 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/ory-am/fosite/compose"
 	customCompose "github.com/jacyzon/gorvp/compose"
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
 	"github.com/ory-am/fosite/token/jwt"
 	"github.com/ory-am/fosite/handler/oauth2"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
-	"github.com/pilu/xrequestid"
 	"github.com/ory-am/fosite"
 	"github.com/go-errors/errors"
 	"strings"
+	"log"
+	"context"
+	"os/signal"
+	"sync"
+	"syscall"
+	"crypto/rand"
+	"encoding/hex"
 )
 
-// TODO move into gorvp struct
-var tokenStrategy = &GoRvpStrategy{init: false}
-
-type GoRvpStrategy struct {
-	*oauth2.RS256JWTStrategy
-	init bool
-}
-
-func SetTokenStrategy(s *oauth2.RS256JWTStrategy) {
-	tokenStrategy.RS256JWTStrategy = s
-	tokenStrategy.init = true
-}
-
-func GetTokenStrategy() (*GoRvpStrategy) {
-	if tokenStrategy.init == false {
-		// TODO init strategy for one-time use
-		panic("Token strategy must set first")
-	}
-	return tokenStrategy
-}
-
 type GoRvp struct {
 	Config       *Config
 	Router       *mux.Router
 	store        *Store
+	metrics      *Metrics
+	tracing      *Tracing
+	accessLogger *AccessLogger
+	listeners    []*Listener
+	servers      []*GracefulServer
+	serveErrors  chan error
+	upgraded     bool
+	sites        Sites
+	keyring      *Keyring
+	// nil unless the login page is enabled
+	loginPages   *LoginPages
 	oauth2       fosite.OAuth2Provider
+	// verifies the secrets of the clients authenticated with an assertion
+	assertionHasher *assertionHasher
+	// secret of the requests gorvp sends to itself, see RequestID
+	internalSecret string
+	stopKeyring  chan struct{}
 	fositeConfig *compose.Config
 }
 
+// New sets up a GoRvp from a loaded config, nothing is listening until Start.
+// Routes added to router are served next to the ones of gorvp, see ComponentCustom,
+// a new router is used if it is nil.
+func New(config *Config, router *mux.Router) (*GoRvp, error) {
+	if router == nil {
+		router = mux.NewRouter()
+	}
+	goRvp := &GoRvp{
+		Config: config,
+		Router: router,
+	}
+	err := goRvp.setup()
+	if err != nil {
+		return nil, err
+	}
+	return goRvp, nil
+}
+
+// Run loads the config, serves until SIGTERM or SIGINT and shuts down gracefully.
+// On SIGUSR2 the listening sockets are handed to a new process before shutting down.
 func (goRvp *GoRvp) Run() (error) {
 	err := goRvp.Config.Load()
 	if (err != nil) {
 		return err;
 	}
+	err = goRvp.setup()
+	if err != nil {
+		return err
+	}
+	err = goRvp.Start(context.Background())
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGTERM, syscall.SIGINT}, upgradeSignals...)...)
+	defer signal.Stop(signals)
+
+wait:
+	for {
+		select {
+		case err = <-goRvp.serveErrors:
+			break wait
+		case sig := <-signals:
+			if !isUpgradeSignal(sig) {
+				break wait
+			}
+			process, upgradeErr := StartUpgradedProcess(goRvp.servers)
+			if upgradeErr != nil {
+				// keep serving with the current process, the new one failed
+				log.Printf("upgrade failed: %s", upgradeErr)
+				continue
+			}
+			log.Printf("started process %d with the listening sockets", process.Pid)
+			goRvp.upgraded = true
+			break wait
+		}
+	}
+
+	shutdownTimeout := goRvp.Config.Server.ShutdownTimeout * time.Second
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+	log.Printf("shutting down, waiting up to %s for in-flight requests", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	goRvp.Shutdown(ctx)
+	return err
+}
+
+// Handler returns the handler of the first listener, the only one if no
+// listeners are configured, for serving gorvp with your own http.Server.
+func (goRvp *GoRvp) Handler() http.Handler {
+	return goRvp.listeners[0].handler
+}
+
+// ListenerHandler returns the handler of the named listener, nil if there is none.
+func (goRvp *GoRvp) ListenerHandler(name string) http.Handler {
+	for _, listener := range goRvp.listeners {
+		if listener.Name == name {
+			return listener.handler
+		}
+	}
+	return nil
+}
+
+// Start listens on the addresses of the listeners, or the sockets inherited
+// from the previous process, and serves in the background.
+func (goRvp *GoRvp) Start(ctx context.Context) error {
+	inherited, err := InheritedListeners()
+	if err != nil {
+		return err
+	}
+	for i, server := range goRvp.servers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := server.Listen(inherited, i); err != nil {
+			return err
+		}
+	}
+	goRvp.Config.WritePidFile()
+
+	goRvp.stopKeyring = make(chan struct{})
+	go goRvp.maintainKeyring(goRvp.stopKeyring)
+
+	goRvp.serveErrors = make(chan error, len(goRvp.servers))
+	for _, server := range goRvp.servers {
+		log.Printf("listening on %s", server.listener.Addr())
+		go func(server *GracefulServer) {
+			if err := server.Serve(); err != nil {
+				goRvp.serveErrors <- err
+			}
+		}(server)
+	}
+	// the previous process drains once the new one serves
+	notifyReady()
+	return nil
+}
+
+// maintainKeyring rotates and retires the signing keys on schedule until stop is closed.
+func (goRvp *GoRvp) maintainKeyring(stop chan struct{}) {
+	rotationPeriod := goRvp.Config.Keyring.RotationPeriod * time.Second
+	retireAfter := goRvp.Config.Keyring.RetireAfter * time.Second
+	if retireAfter == 0 {
+		// a retired key would invalidate the refresh tokens it signed
+		retireAfter = goRvp.Config.Lifespan.RefreshToken * time.Second
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := goRvp.keyring.Maintain(rotationPeriod, retireAfter); err != nil {
+				log.Printf("keyring: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Shutdown stops the servers, waiting for the in-flight requests until ctx
+// is done, then flushes the traces and closes the database.
+func (goRvp *GoRvp) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(goRvp.servers))
+	for _, server := range goRvp.servers {
+		if server.listener == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *GracefulServer) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("shutdown %s: %s", server.listener.Addr(), err)
+				errs <- err
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errs)
+
+	if goRvp.stopKeyring != nil {
+		close(goRvp.stopKeyring)
+	}
+	if !goRvp.upgraded {
+		// the pid file belongs to the new process after an upgrade
+		goRvp.Config.RemovePidFile()
+	}
+	if goRvp.tracing != nil {
+		goRvp.tracing.Shutdown(ctx)
+	}
+	goRvp.store.DB.Close()
+	return <-errs
+}
+
+// setup builds the stores, the oauth2 provider, the routers and the servers.
+func (goRvp *GoRvp) setup() error {
 	goRvp.fositeConfig = &compose.Config{
 		AccessTokenLifespan: goRvp.Config.Lifespan.AccessToken * time.Second,
 		AuthorizeCodeLifespan: goRvp.Config.Lifespan.AuthorizeCode * time.Second,
 	}
 
-	tokenStrategy := &oauth2.RS256JWTStrategy{
-		RS256JWTStrategy: &jwt.RS256JWTStrategy{
-			PrivateKey: goRvp.Config.RsaKey.Token.Key,
-		},
-	}
-
-	SetupSites(goRvp.Config)
-	SetTokenStrategy(tokenStrategy)
+	goRvp.sites = NewSites(goRvp.Config)
 
 	db, err := gorm.Open(goRvp.Config.Database.Type, goRvp.Config.Database.Connection)
 	if err != nil {
 		return errors.New("Cannot open database.")
 	}
 
-	goRvp.store = &Store{
-		DB: db,
+	if goRvp.Config.Tracing.Enabled {
+		tracing, err := NewTracing(goRvp.Config.Tracing)
+		if err != nil {
+			return err
+		}
+		goRvp.tracing = tracing
+	}
+
+	// shared by the listeners, one writer for the log file
+	goRvp.accessLogger = NewAccessLogger(goRvp.Config.AccessLog)
+
+	if goRvp.Config.Metrics.Enabled {
+		goRvp.metrics = NewMetrics()
+		goRvp.metrics.InstrumentDB(db)
 	}
+
+	goRvp.store = &Store{DB: db}
 	goRvp.store.Migrate()
 	goRvp.store.CreateScopeInfo(goRvp.Config)
 
+	// loaded after the migration, the keyring may be kept in the database
+	keyring, err := LoadKeyring(goRvp.Config.Keyring, goRvp.Config.RsaKey.Token.Key, db)
+	if err != nil {
+		return err
+	}
+	goRvp.keyring = keyring
+	tokenStrategy := NewGoRvpStrategy(keyring)
+	goRvp.store.TokenStrategy = tokenStrategy
+	issuer := strings.TrimSuffix(goRvp.Config.Issuer, "/")
+	goRvp.store.AssertionAudiences = []string{issuer + goRvp.Config.Oauth2TokenMountPoint, goRvp.Config.Issuer}
+
+	if goRvp.Config.Login.Enabled {
+		goRvp.loginPages, err = NewLoginPages(goRvp.Config.Login)
+		if err != nil {
+			return err
+		}
+	}
+
+	// enabled handlers
+	factories := []compose.Factory{
+		compose.OAuth2AuthorizeExplicitFactory,
+		customCompose.OAuth2AuthorizeImplicitRefreshFactory,
+		compose.OAuth2ClientCredentialsGrantFactory,
+		compose.OAuth2RefreshTokenGrantFactory,
+		compose.OAuth2ResourceOwnerPasswordCredentialsFactory,
+		compose.OpenIDConnectExplicit,
+		compose.OpenIDConnectImplicit,
+		customCompose.OAuth2JWTBearerFactory,
+	}
+	if goRvp.deviceFlowEnabled() {
+		factories = append(factories, customCompose.OAuth2DeviceCodeFactory)
+	}
 	goRvp.oauth2 = compose.Compose(
 		goRvp.fositeConfig,
 		goRvp.store,
 		&compose.CommonStrategy{
 			// alternatively you could use OAuth2Strategy: compose.NewOAuth2JWTStrategy(mustRSAKey())
 			CoreStrategy: tokenStrategy,
+			// id tokens are signed with the keyring as well
+			OpenIDConnectTokenStrategy: tokenStrategy,
 		},
-		// enabled handlers
-		compose.OAuth2AuthorizeExplicitFactory,
-		customCompose.OAuth2AuthorizeImplicitRefreshFactory,
-		compose.OAuth2ClientCredentialsGrantFactory,
-		compose.OAuth2RefreshTokenGrantFactory,
-		compose.OAuth2ResourceOwnerPasswordCredentialsFactory,
+		factories...,
 	)
-	OAuth2TokenEndpoint := fmt.Sprintf("http://127.0.0.1:%s%s", goRvp.Config.Port, goRvp.Config.Oauth2TokenMountPoint)
+	// the clients with public keys authenticate with an assertion instead of the secret
+	fositeProvider := goRvp.oauth2.(*fosite.Fosite)
+	goRvp.assertionHasher = &assertionHasher{Hasher: fositeProvider.Hasher}
+	fositeProvider.Hasher = goRvp.assertionHasher
+
+	goRvp.setupListeners()
+	OAuth2TokenEndpoint := goRvp.oauth2TokenEndpoint()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	goRvp.internalSecret = hex.EncodeToString(secret)
 
 	for _, trustedClient := range goRvp.Config.TrustedClients {
 		goRvp.store.CreateTrustedClient(&trustedClient)
 		oc := &OwnerClient{
 			TokenEndpoint:      OAuth2TokenEndpoint,
 			TrustedClient:      &trustedClient,
+			Metrics:            goRvp.metrics,
+			internalSecret:     goRvp.internalSecret,
+		}
+		for _, listener := range goRvp.boundListeners(ComponentOAuth2, trustedClient.Listeners) {
+			listener.Router.PathPrefix(trustedClient.TokenMountPoint).Handler(negroni.New(
+				// TODO add limit plugin
+				negroni.Wrap(oc),
+			))
 		}
-		goRvp.Router.PathPrefix(trustedClient.TokenMountPoint).Handler(negroni.New(
-			// TODO add limit plugin
-			negroni.Wrap(oc),
-		))
 		if goRvp.store.OC == nil && trustedClient.Default_provider {
 			goRvp.store.OC = oc
 		}
 	}
 
-	goRvp.Router.HandleFunc(goRvp.Config.Oauth2AuthMountPoint, goRvp.authEndpoint)
-	goRvp.Router.HandleFunc(goRvp.Config.Oauth2TokenMountPoint, goRvp.tokenEndpoint)
+	goRvp.mount(ComponentOAuth2, func(router *mux.Router) {
+		router.HandleFunc(goRvp.Config.Oauth2AuthMountPoint, goRvp.authEndpoint)
+		router.HandleFunc(goRvp.Config.Oauth2TokenMountPoint, goRvp.tokenEndpoint)
+
+		clientHandler := ClientHandler{
+			Router:router.PathPrefix("/client").Subrouter(),
+			Store: goRvp.store,
+		}
+		clientHandler.SetupHandler()
+
+		tokenHandler := TokenHandler{
+			Router:router.PathPrefix(goRvp.Config.Oauth2TokenMountPoint).Subrouter(),
+			Store: goRvp.store,
+			Hasher: goRvp.oauth2.(*fosite.Fosite).Hasher,
+		}
+		tokenHandler.SetupHandler()
+		router.HandleFunc(goRvp.Config.Oauth2IntrospectMountPoint, tokenHandler.TokenIntrospection).Methods("POST")
+		router.HandleFunc(goRvp.Config.Oauth2RevokeMountPoint, tokenHandler.TokenRevocationRFC7009).Methods("POST")
+
+		router.HandleFunc(goRvp.Config.UserInfoMountPoint, goRvp.userInfoEndpoint).Methods("GET", "POST")
+		if goRvp.loginPages != nil {
+			router.HandleFunc(goRvp.Config.Login.MountPoint, goRvp.loginEndpoint).Methods("GET", "POST")
+		}
+		if goRvp.deviceFlowEnabled() {
+			router.HandleFunc(goRvp.Config.Oauth2DeviceAuthorizationMountPoint, goRvp.deviceAuthorizationEndpoint(&tokenHandler)).Methods("POST")
+			router.HandleFunc(goRvp.Config.DeviceVerificationMountPoint, goRvp.deviceVerificationEndpoint).Methods("GET", "POST")
+		}
+		router.HandleFunc(OpenIDConfigurationPath, goRvp.openIDConfigurationEndpoint).Methods("GET")
+		router.HandleFunc(JWKSPath, goRvp.jwksEndpoint).Methods("GET")
+	})
 
 	// TODO plugins support
-	jwtProxy := NewJwtProxy(goRvp.store, tokenStrategy, goRvp.Config)
+	jwtProxy := NewJwtProxy(goRvp.store, goRvp.sites, goRvp.Config)
 	m := negroni.New(jwtProxy)
-	goRvp.Config.SetupRoute(goRvp.Router, m)
+	goRvp.mount(ComponentFrontend, func(router *mux.Router) {
+		goRvp.Config.SetupRoute(router, m)
+	})
 
 	// admin API
-	adminHandler := AdminHandler{
-		Router:goRvp.Router.PathPrefix("/admin").Subrouter(),
-		Store: goRvp.store,
+	goRvp.mount(ComponentAdmin, func(router *mux.Router) {
+		adminHandler := AdminHandler{
+			Router:router.PathPrefix("/admin").Subrouter(),
+			Store: goRvp.store,
+			Keyring: goRvp.keyring,
+			DeviceFlow: goRvp.deviceFlowEnabled(),
+		}
+		adminHandler.SetupHandler()
+	})
+
+	goRvp.mount(ComponentConnections, func(router *mux.Router) {
+		connectionHandler := ConnectionHandler{
+			Router:router.PathPrefix("/connections").Subrouter(),
+			Store: goRvp.store,
+		}
+		connectionHandler.SetupHandler()
+	})
+
+	var servers []*GracefulServer
+	if goRvp.metrics != nil {
+		if metricsServer := goRvp.setupMetricsEndpoint(); metricsServer != nil {
+			servers = append(servers, metricsServer)
+		}
 	}
-	adminHandler.SetupHandler()
 
-	clientHandler := ClientHandler{
-		Router:goRvp.Router.PathPrefix("/client").Subrouter(),
-		Store: goRvp.store,
+	errorPages, err := NewErrorPages(goRvp.Config)
+	if err != nil {
+		return err
 	}
-	clientHandler.SetupHandler()
 
-	tokenHandler := TokenHandler{
-		Router:goRvp.Router.PathPrefix(goRvp.Config.Oauth2TokenMountPoint).Subrouter(),
-		Store: goRvp.store,
-		Hasher: goRvp.oauth2.(*fosite.Fosite).Hasher,
+	// the listeners go first, see InheritedListeners
+	listenerServers := make([]*GracefulServer, len(goRvp.listeners))
+	for i, listener := range goRvp.listeners {
+		tlsConfig, err := listener.tlsConfig()
+		if err != nil {
+			return err
+		}
+		serverConfig := goRvp.Config.Server
+		listener.handler = goRvp.middleware(listener, errorPages)
+		listenerServers[i] = NewGracefulServer(&http.Server{
+			Addr:              listener.Address,
+			Handler:           listener.handler,
+			TLSConfig:         tlsConfig,
+			ReadTimeout:       serverConfig.ReadTimeout * time.Second,
+			ReadHeaderTimeout: serverConfig.ReadHeaderTimeout * time.Second,
+			WriteTimeout:      serverConfig.WriteTimeout * time.Second,
+			IdleTimeout:       serverConfig.IdleTimeout * time.Second,
+		})
 	}
-	tokenHandler.SetupHandler()
+	goRvp.servers = append(listenerServers, servers...)
+	return nil
+}
 
-	connectionHandler := ConnectionHandler{
-		Router:goRvp.Router.PathPrefix("/connections").Subrouter(),
-		Store: goRvp.store,
+// middleware attaches the basic middleware in front of the router of listener.
+func (goRvp *GoRvp) middleware(listener *Listener, errorPages ErrorPages) http.Handler {
+	serverConfig := goRvp.Config.Server
+	requestID := NewRequestID(16)
+	requestID.internalSecret = goRvp.internalSecret
+	n := negroni.New(negroni.NewRecovery(), NewForwarded(goRvp.Config.GetTrustedProxies()), requestID)
+	if goRvp.tracing != nil {
+		n.Use(goRvp.tracing)
+	}
+	if goRvp.Config.AccessLog.Path == "" {
+		n.Use(negroni.NewLogger())
+	}
+	n.Use(goRvp.accessLogger)
+	if goRvp.metrics != nil {
+		n.Use(goRvp.metrics.Middleware(listener))
+	}
+	n.Use(errorPages)
+	n.Use(AllowedHosts(listener.Hosts))
+	if serverConfig.MaxBodySize > 0 || serverConfig.BufferRequest {
+		n.Use(NewBodyLimit(serverConfig.MaxBodySize, serverConfig.BufferRequest))
 	}
-	connectionHandler.SetupHandler()
+	n.UseHandler(listener.Router)
+	return n
+}
 
-	// attach basic middleware
-	n := negroni.New(negroni.NewRecovery(), negroni.NewLogger(), xrequestid.New(16), negroni.Wrap(goRvp.Router))
-	goRvp.Config.WritePidFile()
-	n.Run(":" + goRvp.Config.Port)
-	return nil
+func (goRvp *GoRvp) setupMetricsEndpoint() *GracefulServer {
+	path := goRvp.Config.Metrics.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	if goRvp.Config.Metrics.Listen == "" {
+		if len(goRvp.boundListeners(ComponentMetrics, nil)) == 0 {
+			log.Printf("metrics are not served, set metrics.listen or bind.metrics")
+		}
+		goRvp.mount(ComponentMetrics, func(router *mux.Router) {
+			router.Handle(path, goRvp.metrics.Handler())
+		})
+		return nil
+	}
+	metricsRouter := mux.NewRouter()
+	metricsRouter.Handle(path, goRvp.metrics.Handler())
+	return NewGracefulServer(&http.Server{
+		Addr:    goRvp.Config.Metrics.Listen,
+		Handler: metricsRouter,
+	})
 }
 
 func (c *Config) WritePidFile() {
@@ -159,55 +483,123 @@ func (c *Config) WritePidFile() {
 	ioutil.WriteFile(c.PidFile, pid, 0644)
 }
 
+// RemovePidFile removes the pid file if it is still owned by this process.
+func (c *Config) RemovePidFile() {
+	if c.PidFile == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(c.PidFile)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(c.PidFile)
+}
+
 func (goRvp *GoRvp) authEndpoint(rw http.ResponseWriter, req *http.Request) {
+	// the user is authenticated by a token of a trusted client, or on the login
+	// page if it is enabled and the request has no token
 	jwtClaims, _, err := GetTokenClaimsFromBearer(goRvp.store, req)
-	if err != nil {
-		WriteError(rw, err)
+	var loginSession *LoginSession
+	if err == ErrTokenNotFoundBearer && goRvp.loginPages != nil {
+		req.ParseForm()
+		loginSession = goRvp.loginSessionOf(req)
+		if loginSession == nil {
+			goRvp.redirectToLogin(rw, req)
+			return
+		}
+	} else if err != nil {
+		WriteRequestError(rw, req, err)
 		return
 	}
 
 	// This context will be passed to all methods.
-	ctx := fosite.NewContext()
+	ctx, span := startSpan(req.Context(), "fosite.authorize")
+	defer span.End()
 
 	// Let's create an AuthorizeRequest object!
 	// It will analyze the request and extract important information like scopes, response type and others.
 	req.ParseForm()
+	loopbackRedirectURI := goRvp.matchLoopbackRedirectURI(req.Form.Get("client_id"), req.Form)
 	ar, err := goRvp.oauth2.NewAuthorizeRequest(ctx, req)
+	restoreRedirectURI(ar, loopbackRedirectURI)
 	if err != nil {
 		goRvp.oauth2.WriteAuthorizeError(rw, ar, err)
 		return
 	}
 
-	// check if the token is from trusted client
-	authTokenClient, err := goRvp.store.GetRvpClient(jwtClaims.Audience)
-	if err != nil {
-		WriteError(rw, ErrTokenInvalid)
-		return
-	}
-	authTokenRVPClient := authTokenClient
-	if !authTokenRVPClient.IsTrusted() {
-		WriteError(rw, ErrInvalidClient)
-		return
+	var subject string
+	var authTime time.Time
+	if loginSession != nil {
+		subject = loginSession.Subject
+		authTime = loginSession.AuthTime
+	} else {
+		// check if the token is from trusted client
+		authTokenClient, err := goRvp.store.GetRvpClient(jwtClaims.Audience)
+		if err != nil {
+			WriteRequestError(rw, req, ErrTokenInvalid)
+			return
+		}
+		authTokenRVPClient := authTokenClient
+		if !authTokenRVPClient.IsTrusted() {
+			WriteRequestError(rw, req, ErrInvalidClient)
+			return
+		}
+		subject = jwtClaims.Subject
+		// the user logged in when the token of the trusted client was issued
+		authTime = jwtClaims.IssuedAt
 	}
 
 	// check scopes
 	err = GrantScope(goRvp.oauth2, ar)
 	if err != nil {
-		WriteError(rw, ErrClientPermission)
+		WriteRequestError(rw, req, ErrClientPermission)
+		return
+	}
+	// the trusted clients ask for consent themselves
+	if loginSession != nil && !goRvp.consent(rw, req, ar, subject) {
 		return
 	}
 	requestClient := ar.GetClient().(Client)
 	clientID := requestClient.GetID()
 	grantedScopes := ar.GetGrantedScopes()
 
-	connection, err := goRvp.store.UpdateConnection(clientID, jwtClaims.Subject, grantedScopes)
+	// check app type and relevant check, before the connection is updated or
+	// any code or token is issued
+	validClient := true
+	switch requestClient.GetAppType() {
+	case AppTypeAndroid:
+		if requestClient.GetPackageName() != ar.GetRequestForm().Get("package_name") {
+			validClient = false
+		} else if requestClient.GetKeyHash() != strings.ToLower(ar.GetRequestForm().Get("key_hash")) {
+			validClient = false
+		}
+	case AppTypeIos:
+		if requestClient.GetBundleID() != ar.GetRequestForm().Get("bundle_id") {
+			validClient = false
+		} else if requestClient.GetTeamID() != strings.ToUpper(ar.GetRequestForm().Get("team_id")) {
+			validClient = false
+		}
+	}
+	if !validClient {
+		WriteRequestError(rw, req, ErrInvalidClient)
+		return
+	}
+
+	connection, err := goRvp.store.UpdateConnection(clientID, subject, grantedScopes)
 	if err != nil {
-		WriteError(rw, fosite.ErrServerError)
+		WriteRequestError(rw, req, fosite.ErrServerError)
 		return
 	}
 
 	// Now that the user is authorized, we set up a session:
-	session := NewSession(goRvp.Config, jwtClaims.Subject, grantedScopes, requestClient.GetID(), connection)
+	session := NewSession(goRvp.Config, subject, grantedScopes, requestClient.GetID(), connection)
+	session.IDClaims.AuthTime = authTime
+
+	// proof key for code exchange (RFC 7636)
+	if err := goRvp.setCodeChallenge(ar, session); err != nil {
+		goRvp.oauth2.WriteAuthorizeError(rw, ar, err)
+		return
+	}
 
 	// Now we need to get a response. This is the place where the AuthorizeEndpointHandlers kick in and start processing the request.
 	// NewAuthorizeResponse is capable of running multiple response type handlers which in turn enables this library
@@ -218,21 +610,8 @@ func (goRvp *GoRvp) authEndpoint(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// check app type and relevant check
-	validClient := true
-	switch requestClient.GetAppType() {
-	case AppTypeAndroid:
-		if requestClient.GetPackageName() != ar.GetRequestForm().Get("package_name") {
-			validClient = false
-		} else if requestClient.GetKeyHash() != strings.ToLower(ar.GetRequestForm().Get("key_hash")) {
-			validClient = false
-		}
-		if validClient {
-			response.AddFragment("start_activity", requestClient.GetStartActivity())
-		} else {
-			WriteError(rw, ErrInvalidClient)
-			return
-		}
+	if requestClient.GetAppType() == AppTypeAndroid {
+		response.AddFragment("start_activity", requestClient.GetStartActivity())
 	}
 
 	// Last but not least, send the response!
@@ -241,13 +620,49 @@ func (goRvp *GoRvp) authEndpoint(rw http.ResponseWriter, req *http.Request) {
 
 func (goRvp *GoRvp)tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 	// This context will be passed to all methods.
-	ctx := fosite.NewContext()
+	ctx, span := startSpan(req.Context(), "fosite.token")
+	defer span.End()
 
 	// Create an empty session object which will be passed to the request handlers
 	session := NewSession(goRvp.Config, "", []string{}, "", &Connection{})
 
 	req.ParseForm()
 	grantType := req.PostForm.Get("grant_type")
+	// fosite compares the secret of the basic auth, the assertion is verified in its place
+	if clientID, assertion, ok := clientAssertionOf(req); ok {
+		if req.Header.Get("Authorization") != "" {
+			// a single client authentication method is allowed
+			WriteRequestError(rw, req, ErrInvalidRequest)
+			return
+		}
+		secret, err := goRvp.authenticateAssertion(ctx, clientID, assertion)
+		if err != nil {
+			WriteRequestError(rw, req, err)
+			return
+		}
+		defer goRvp.assertionHasher.forget(secret)
+		req.SetBasicAuth(clientID, secret)
+		if grantType == gorvpOauth2.GrantTypeJWTBearer && req.PostForm.Get("assertion") == assertion {
+			// the same assertion is the grant, it was accepted once already
+			ctx = gorvpOauth2.WithVerifiedAssertion(ctx, assertion)
+		}
+	} else if _, _, ok := req.BasicAuth(); !ok && grantType == gorvpOauth2.GrantTypeJWTBearer {
+		// the assertion of the grant authenticates the client as well
+		assertion := req.PostForm.Get("assertion")
+		if clientID, ok := assertionIssuer(assertion); ok {
+			secret, err := goRvp.authenticateAssertion(ctx, clientID, assertion)
+			if err != nil {
+				WriteRequestError(rw, req, err)
+				return
+			}
+			defer goRvp.assertionHasher.forget(secret)
+			req.SetBasicAuth(clientID, secret)
+			ctx = gorvpOauth2.WithVerifiedAssertion(ctx, assertion)
+		}
+	} else if _, _, ok := req.BasicAuth(); !ok && req.PostForm.Get("client_secret") != "" {
+		// client_secret_post, fosite only reads the credentials of the basic auth
+		req.SetBasicAuth(req.PostForm.Get("client_id"), req.PostForm.Get("client_secret"))
+	}
 	if grantType == "refresh_token" {
 		_, _, ok := req.BasicAuth()
 		if !ok {
@@ -255,33 +670,53 @@ func (goRvp *GoRvp)tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 			// this is for implicit refresh flow for public client like android and web app
 			claims, _, err := GetTokenClaimsFromRefreshToken(goRvp.store, req)
 			if err != nil {
-				WriteError(rw, err)
+				WriteRequestError(rw, req, err)
 				return
 			}
 			req.SetBasicAuth(claims.Audience, "")
 		}
+	} else if grantType == gorvpOauth2.GrantTypeDeviceCode {
+		if _, _, ok := req.BasicAuth(); !ok && req.PostForm.Get("client_id") != "" {
+			// devices are public clients, the device code proves the client
+			req.SetBasicAuth(req.PostForm.Get("client_id"), "")
+		}
+	} else if grantType == "authorization_code" {
+		if _, _, ok := req.BasicAuth(); !ok && req.PostForm.Get("client_id") != "" {
+			// public clients have no secret, the code verifier proves the client
+			req.SetBasicAuth(req.PostForm.Get("client_id"), "")
+		}
 	}
 
 	// This will create an access request object and iterate through the registered TokenEndpointHandlers to validate the request.
 	ar, err := goRvp.oauth2.NewAccessRequest(ctx, req, session)
 
 	if err != nil {
+		// fosite does not know the errors of the device polling
+		if writeDeviceError(rw, err) {
+			return
+		}
 		goRvp.oauth2.WriteAccessError(rw, ar, err)
 		return
 	}
 
+	// check the ip rules of the authenticated client
+	if !ar.GetClient().(Client).GetIPFilter().Allowed(RealIP(req)) {
+		WriteRequestError(rw, req, ErrIPNotAllowed)
+		return
+	}
+
 	// TODO refactoring: select app type
 	if ar.GetGrantTypes().Exact("password") {
 		client := ar.GetClient().(Client)
 		clientID := client.GetID()
 		if !client.GetFullScopes().Grant(ar) {
-			WriteError(rw, ErrClientPermission)
+			WriteRequestError(rw, req, ErrClientPermission)
 			return
 		}
 		username := req.PostForm.Get("username")
 		connection, err := goRvp.store.UpdateConnection(clientID, username, ar.GetGrantedScopes())
 		if err != nil {
-			WriteError(rw, err)
+			WriteRequestError(rw, req, err)
 			return
 		}
 		session.SetScopes(ar.GetGrantedScopes())
@@ -291,7 +726,11 @@ func (goRvp *GoRvp)tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 	} else if ar.GetGrantTypes().Exact("authorization_code") {
 		claims, connection, err := GetTokenClaimsFromCode(goRvp.store, req)
 		if err != nil {
-			WriteError(rw, err)
+			WriteRequestError(rw, req, err)
+			return
+		}
+		if err := verifyCodeVerifier(claims, req.PostForm.Get("code_verifier")); err != nil {
+			goRvp.oauth2.WriteAccessError(rw, ar, err)
 			return
 		}
 		session.CopyScopeFromClaims(claims)
@@ -302,11 +741,25 @@ func (goRvp *GoRvp)tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 		client := ar.GetClient().(Client)
 		clientID := client.GetID()
 		if !client.GetFullScopes().Grant(ar) {
-			WriteError(rw, ErrClientPermission)
+			WriteRequestError(rw, req, ErrClientPermission)
+			return
+		}
+		session.SetScopes(ar.GetGrantedScopes())
+		session.JWTClaims.Audience = clientID
+	} else if ar.GetGrantTypes().Exact(gorvpOauth2.GrantTypeJWTBearer) {
+		client := ar.GetClient().(Client)
+		clientID := client.GetID()
+		if !client.GetFullScopes().Grant(ar) {
+			WriteRequestError(rw, req, ErrClientPermission)
 			return
 		}
 		session.SetScopes(ar.GetGrantedScopes())
 		session.JWTClaims.Audience = clientID
+		// the client acts on its own behalf
+		session.JWTClaims.Subject = clientID
+	} else if ar.GetGrantTypes().Exact(gorvpOauth2.GrantTypeDeviceCode) {
+		// the session was set up when the user approved the device
+		session = ar.GetSession().(*Session)
 	}
 
 	// Next we create a response for the access request. Again, we iterate through the TokenEndpointHandlers
@@ -317,8 +770,16 @@ func (goRvp *GoRvp)tokenEndpoint(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if entry := GetAccessLogEntry(req); entry != nil {
+		entry.Subject = session.JWTClaims.Subject
+		entry.ClientID = session.JWTClaims.Audience
+		entry.ConnectionID, _ = session.JWTClaims.Get("cni").(string)
+		entry.Scopes = ar.GetGrantedScopes()
+	}
+
 	// All done, send the response.
 	goRvp.oauth2.WriteAccessResponse(rw, ar, response)
+	goRvp.metrics.TokenIssued(grantType)
 
 	// The client now has a valid access token
 }
@@ -0,0 +1,236 @@
+package gorvp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// listenFDsEnv holds the number of listening sockets handed to a new process
+// on upgrade, the sockets start at fd 3 in the order of the servers.
+const listenFDsEnv = "GORVP_LISTEN_FDS"
+
+const listenFDsStart = 3
+
+// readyFDEnv holds the fd of the pipe the new process writes to once it
+// serves on the inherited sockets, the previous process drains only then.
+const readyFDEnv = "GORVP_READY_FD"
+
+// readyTimeout is how long the previous process waits for the new one.
+const readyTimeout = time.Minute
+
+// GracefulServer is an http.Server which waits for the in-flight requests,
+// including proxied websocket connections, before it stops.
+type GracefulServer struct {
+	*http.Server
+	listener net.Listener
+	inFlight sync.WaitGroup
+	mutex    sync.Mutex
+	hijacked map[net.Conn]struct{}
+}
+
+func NewGracefulServer(server *http.Server) *GracefulServer {
+	s := &GracefulServer{
+		Server:   server,
+		hijacked: make(map[net.Conn]struct{}),
+	}
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		handler.ServeHTTP(rw, r)
+
+		// the upgraded connection is closed once the handler returns
+		if conn, ok := r.Context().Value(connKey).(net.Conn); ok {
+			s.mutex.Lock()
+			delete(s.hijacked, conn)
+			s.mutex.Unlock()
+		}
+	})
+	server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, connKey, conn)
+	}
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			s.mutex.Lock()
+			s.hijacked[conn] = struct{}{}
+			s.mutex.Unlock()
+		}
+	}
+	return s
+}
+
+// Listen uses the listener inherited from the previous process at index,
+// or opens a new one.
+func (s *GracefulServer) Listen(inherited []net.Listener, index int) error {
+	if index < len(inherited) {
+		debug("Using inherited listener %s", inherited[index].Addr())
+		s.listener = inherited[index]
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	return nil
+}
+
+// Serve blocks until the server is shut down.
+func (s *GracefulServer) Serve() error {
+	var err error
+	if s.TLSConfig != nil {
+		err = s.Server.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.Server.Serve(s.listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for the in-flight requests
+// until ctx is done, the remaining connections are closed after that.
+func (s *GracefulServer) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.Server.Close()
+	s.mutex.Lock()
+	for conn := range s.hijacked {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	return ctx.Err()
+}
+
+func (s *GracefulServer) listenerFile() (*os.File, error) {
+	listener, ok := s.listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.Errorf("can not hand over listener %s", s.listener.Addr())
+	}
+	return listener.File()
+}
+
+// InheritedListeners returns the listeners handed over by the previous process.
+func InheritedListeners() ([]net.Listener, error) {
+	count, _ := strconv.Atoi(os.Getenv(listenFDsEnv))
+	os.Unsetenv(listenFDsEnv)
+
+	listeners := make([]net.Listener, count)
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFDsStart+i), fmt.Sprintf("listener-%d", i))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.Errorf("can not inherit listener %d: %s", i, err)
+		}
+		listeners[i] = listener
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the previous process, if any, that the listeners are served.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	os.Unsetenv(readyFDEnv)
+	if err != nil {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		log.Printf("can not notify the previous process: %s", err)
+	}
+}
+
+// StartUpgradedProcess starts the binary again with the listening sockets of
+// servers and waits until the new process serves on them, so this one can
+// drain. The new process is killed if it is not ready within readyTimeout.
+func StartUpgradedProcess(servers []*GracefulServer) (*os.Process, error) {
+	files := make([]*os.File, len(servers))
+	for i, server := range servers {
+		file, err := server.listenerFile()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		files[i] = file
+	}
+
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		notify.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(files)),
+		fmt.Sprintf("%s=%d", readyFDEnv, listenFDsStart+len(files)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, notify)
+	err = cmd.Start()
+	// only the new process holds the write end, reading fails once it exits
+	notify.Close()
+	if err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	select {
+	case err = <-readErr:
+		if err == nil {
+			return cmd.Process, nil
+		}
+		// wait for the exit status, the read fails before it is reaped
+		select {
+		case <-exited:
+			return nil, errors.Errorf("process %d exited before it was ready: %s", cmd.Process.Pid, cmd.ProcessState)
+		case <-time.After(time.Second):
+			cmd.Process.Kill()
+			return nil, errors.Errorf("process %d closed the ready pipe: %s", cmd.Process.Pid, err)
+		}
+	case <-time.After(readyTimeout):
+		cmd.Process.Kill()
+		return nil, errors.Errorf("process %d was not ready within %s", cmd.Process.Pid, readyTimeout)
+	}
+}
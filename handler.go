@@ -8,6 +8,9 @@ type Handler struct {
 	isReverseProxy bool
 	isStatic       bool
 	uri            string
+	pattern        string
+	site           string
 	server         http.Handler
 	scopes         ConfigScopes
+	ipFilter       *IPFilter
 }
@@ -0,0 +1,132 @@
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ory-am/fosite"
+	"github.com/ory-am/fosite/handler/oauth2"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// GrantTypeDeviceCode is the grant type of the device access token request (RFC 8628).
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceError is an error of the device access token request, written as
+// the error code of the token endpoint (RFC 8628 section 3.5).
+type DeviceError struct {
+	Name        string
+	Description string
+}
+
+func (e *DeviceError) Error() string {
+	return e.Name
+}
+
+var (
+	ErrAuthorizationPending = &DeviceError{"authorization_pending", "The user has not approved the request yet"}
+	ErrSlowDown             = &DeviceError{"slow_down", "The device polls too often, the interval is increased by 5 seconds"}
+	ErrDeviceAccessDenied   = &DeviceError{"access_denied", "The user denied the request"}
+	ErrExpiredToken         = &DeviceError{"expired_token", "The device code expired, start a new device authorization request"}
+)
+
+// DeviceCodeStorage keeps the device codes and the requests approved by the users.
+type DeviceCodeStorage interface {
+	// GetDeviceCodeSession returns the request the user approved for the
+	// device code, or one of the DeviceErrors.
+	GetDeviceCodeSession(ctx context.Context, deviceCode string, session fosite.Session) (fosite.Requester, error)
+	// RedeemDeviceCode claims the approved device code at once, it fails if
+	// it is already claimed by another token request.
+	RedeemDeviceCode(ctx context.Context, deviceCode string) error
+	InvalidateDeviceCodeSession(ctx context.Context, deviceCode string) error
+}
+
+// DeviceCodeGrantHandler issues the tokens of the device authorization grant
+// once the user approved the request on the verification page.
+type DeviceCodeGrantHandler struct {
+	AccessTokenStrategy  oauth2.AccessTokenStrategy
+	RefreshTokenStrategy oauth2.RefreshTokenStrategy
+
+	DeviceCodeStorage        DeviceCodeStorage
+	AccessTokenStorage       oauth2.AccessTokenStorage
+	RefreshTokenGrantStorage oauth2.RefreshTokenGrantStorage
+
+	// AccessTokenLifespan defines the lifetime of an access token.
+	AccessTokenLifespan time.Duration
+}
+
+func (c *DeviceCodeGrantHandler) HandleTokenEndpointRequest(ctx context.Context, req *http.Request, requester fosite.AccessRequester) error {
+	if !requester.GetGrantTypes().Exact(GrantTypeDeviceCode) {
+		return errors.Wrap(fosite.ErrUnknownRequest, "")
+	}
+
+	if !requester.GetClient().GetGrantTypes().Has(GrantTypeDeviceCode) {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The client is not allowed to use the device code grant")
+	}
+
+	deviceCode := req.PostForm.Get("device_code")
+	if deviceCode == "" {
+		return errors.Wrap(fosite.ErrInvalidRequest, "The device code is missing")
+	}
+	approved, err := c.DeviceCodeStorage.GetDeviceCodeSession(ctx, deviceCode, requester.GetSession())
+	if err != nil {
+		return err
+	}
+
+	if approved.GetClient().GetID() != requester.GetClient().GetID() {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The device code was issued to another client")
+	}
+	// the tokens of a device code are issued once, even to concurrent polls
+	if err := c.DeviceCodeStorage.RedeemDeviceCode(ctx, deviceCode); err != nil {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The device code was already used")
+	}
+
+	requester.SetSession(approved.GetSession())
+	requester.SetRequestedScopes(approved.GetRequestedScopes())
+	for _, scope := range approved.GetGrantedScopes() {
+		requester.GrantScope(scope)
+	}
+	// the lifespan starts with the token, not with the approval
+	requester.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().Add(c.AccessTokenLifespan))
+	return nil
+}
+
+func (c *DeviceCodeGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, req *http.Request, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !requester.GetGrantTypes().Exact(GrantTypeDeviceCode) {
+		return errors.Wrap(fosite.ErrUnknownRequest, "")
+	}
+
+	token, signature, err := c.AccessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+
+	var refreshToken, refreshSignature string
+	if requester.GetGrantedScopes().Has("offline") {
+		refreshToken, refreshSignature, err = c.RefreshTokenStrategy.GenerateRefreshToken(ctx, requester)
+		if err != nil {
+			return errors.Wrap(fosite.ErrServerError, err.Error())
+		}
+		if err := c.RefreshTokenGrantStorage.CreateRefreshTokenSession(ctx, refreshSignature, requester); err != nil {
+			return errors.Wrap(fosite.ErrServerError, err.Error())
+		}
+	}
+	if err := c.AccessTokenStorage.CreateAccessTokenSession(ctx, signature, requester); err != nil {
+		return errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+	// a device code is exchanged once
+	if err := c.DeviceCodeStorage.InvalidateDeviceCodeSession(ctx, req.PostForm.Get("device_code")); err != nil {
+		return errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+
+	responder.SetAccessToken(token)
+	responder.SetTokenType("bearer")
+	responder.SetExtra("expires_in", int64(c.AccessTokenLifespan/time.Second))
+	responder.SetExtra("scope", strings.Join(requester.GetGrantedScopes(), " "))
+	if refreshToken != "" {
+		responder.SetExtra("refresh_token", refreshToken)
+	}
+	return nil
+}
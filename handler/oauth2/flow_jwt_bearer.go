@@ -0,0 +1,106 @@
+package oauth2
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ory-am/fosite"
+	"github.com/ory-am/fosite/handler/oauth2"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// GrantTypeJWTBearer is the grant type exchanging a jwt assertion signed by the
+// client for an access token (RFC 7523 section 2.1).
+const GrantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// AssertionStorage verifies the jwt assertions with the public keys of the clients.
+type AssertionStorage interface {
+	// VerifyAssertion verifies the assertion the client signed for itself, each
+	// assertion is accepted once.
+	VerifyAssertion(ctx context.Context, clientID string, assertion string) error
+}
+
+type verifiedAssertionKey struct{}
+
+// WithVerifiedAssertion tells the handler the assertion was verified when the
+// client authenticated with it.
+func WithVerifiedAssertion(ctx context.Context, assertion string) context.Context {
+	return context.WithValue(ctx, verifiedAssertionKey{}, assertion)
+}
+
+func verifiedAssertion(ctx context.Context) string {
+	assertion, _ := ctx.Value(verifiedAssertionKey{}).(string)
+	return assertion
+}
+
+// JWTBearerGrantHandler issues the access tokens of the jwt bearer grant, the
+// assertion is signed by the client, which is the subject of the token.
+type JWTBearerGrantHandler struct {
+	AccessTokenStrategy oauth2.AccessTokenStrategy
+
+	AssertionStorage   AssertionStorage
+	AccessTokenStorage oauth2.AccessTokenStorage
+
+	ScopeStrategy fosite.ScopeStrategy
+
+	// AccessTokenLifespan defines the lifetime of an access token.
+	AccessTokenLifespan time.Duration
+}
+
+func (c *JWTBearerGrantHandler) HandleTokenEndpointRequest(ctx context.Context, req *http.Request, requester fosite.AccessRequester) error {
+	if !requester.GetGrantTypes().Exact(GrantTypeJWTBearer) {
+		return errors.Wrap(fosite.ErrUnknownRequest, "")
+	}
+
+	client := requester.GetClient()
+	if !client.GetGrantTypes().Has(GrantTypeJWTBearer) {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The client is not allowed to use the jwt bearer grant")
+	}
+	// fosite does not authenticate public clients
+	if client.IsPublic() {
+		return errors.Wrap(fosite.ErrInvalidGrant, "Public clients can not use the jwt bearer grant")
+	}
+	for _, scope := range requester.GetRequestedScopes() {
+		if !c.ScopeStrategy(client.GetScopes(), scope) {
+			return errors.Wrap(fosite.ErrInvalidScope, "The client is not allowed to request scope "+scope)
+		}
+	}
+
+	assertion := req.PostForm.Get("assertion")
+	if assertion == "" {
+		return errors.Wrap(fosite.ErrInvalidRequest, "The assertion is missing")
+	}
+	// the client may have authenticated with the assertion itself, which was
+	// verified then, each assertion is accepted once
+	if verifiedAssertion(ctx) != assertion {
+		if err := c.AssertionStorage.VerifyAssertion(ctx, client.GetID(), assertion); err != nil {
+			return errors.Wrap(fosite.ErrInvalidGrant, err.Error())
+		}
+	}
+
+	requester.GetSession().SetExpiresAt(fosite.AccessToken, time.Now().Add(c.AccessTokenLifespan))
+	return nil
+}
+
+func (c *JWTBearerGrantHandler) PopulateTokenEndpointResponse(ctx context.Context, req *http.Request, requester fosite.AccessRequester, responder fosite.AccessResponder) error {
+	if !requester.GetGrantTypes().Exact(GrantTypeJWTBearer) {
+		return errors.Wrap(fosite.ErrUnknownRequest, "")
+	}
+
+	token, signature, err := c.AccessTokenStrategy.GenerateAccessToken(ctx, requester)
+	if err != nil {
+		return errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+	if err := c.AccessTokenStorage.CreateAccessTokenSession(ctx, signature, requester); err != nil {
+		return errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+
+	// no refresh token, the client signs a new assertion instead (RFC 7523 section 2.1)
+	responder.SetAccessToken(token)
+	responder.SetTokenType("bearer")
+	responder.SetExtra("expires_in", int64(c.AccessTokenLifespan/time.Second))
+	responder.SetExtra("scope", strings.Join(requester.GetGrantedScopes(), " "))
+	return nil
+}
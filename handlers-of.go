@@ -12,12 +12,15 @@ func handlerOf(backendDoc Frontend, hasCustom404 bool, custom404 string) *Handle
 	uri := backendDoc.Backend
 	debug("Setting up the HTTP handler that will serve %s", uri)
 
+	// rules are validated when the config is loaded
+	ipFilter, _ := NewIPFilter(backendDoc.Allow, backendDoc.Deny)
 	handler := &Handler{
 		isReverseProxy: false,
 		isStatic: false,
 		uri: uri,
 		server: nil,
 		scopes: backendDoc.Scopes,
+		ipFilter: ipFilter,
 	}
 	isStatic := isLocalPath(uri)
 
@@ -29,7 +32,14 @@ func handlerOf(backendDoc Frontend, hasCustom404 bool, custom404 string) *Handle
 		handler.server = newStaticServer(uri, hasCustom404, custom404)
 	} else {
 		handler.isReverseProxy = true
-		handler.server = ReverseProxyServer(uri)
+		handler.server = reverseProxyServer(uri, backendDoc.RewriteHost)
+		if !backendDoc.PassBackendErrors {
+			handler.server = newBackendErrorServer(handler.server)
+		}
+	}
+
+	if backendDoc.MaxBodySize > 0 || backendDoc.BufferRequest {
+		handler.server = NewBodyLimit(backendDoc.MaxBodySize, backendDoc.BufferRequest).Handler(handler.server)
 	}
 
 	return handler
@@ -52,6 +62,7 @@ func handlersOf(backend map[string]Frontend) Handlers {
 
 	for path, backendDoc := range backend {
 		handlers[path] = handlerOf(backendDoc, hasCustom404, custom404)
+		handlers[path].pattern = path
 	}
 
 	return handlers
@@ -0,0 +1,102 @@
+package gorvp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ConfigCIDRs is a list of CIDR blocks, a single IP is accepted as well.
+type ConfigCIDRs []string
+
+// IPFilter holds the allow and deny rules of a route or a client.
+// Deny rules win over allow rules, an empty allow list allows every address.
+type IPFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+func (c ConfigCIDRs) Parse() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(c))
+	for _, cidr := range c {
+		ipNet, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func NewIPFilter(allow ConfigCIDRs, deny ConfigCIDRs) (*IPFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	allowNets, err := allow.Parse()
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := deny.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return &IPFilter{
+		Allow: allowNets,
+		Deny:  denyNets,
+	}, nil
+}
+
+// Allowed reports whether ip passes the filter, a nil filter allows everything.
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(f.Deny, ip) {
+		return false
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	return containsIP(f.Allow, ip)
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", cidr)
+	}
+	return ipNet, nil
+}
+
+func parseHostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package gorvp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const JWKSPath = "/.well-known/jwks.json"
+
+// JSONWebKey is the public part of a signing key (RFC 7517).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func NewJSONWebKey(key crypto.PublicKey) JSONWebKey {
+	jwk := thumbprintMembers(key)
+	jwk.Use = "sig"
+	jwk.Algorithm, _ = AlgorithmOf(key)
+	jwk.KeyID = KeyID(key)
+	return jwk
+}
+
+// KeyID is the RFC 7638 thumbprint of the key, it stays the same as long as
+// the key does.
+func KeyID(key crypto.PublicKey) string {
+	// the required members in lexicographic order without whitespace
+	members := thumbprintMembers(key)
+	var thumbprint string
+	switch members.KeyType {
+	case "RSA":
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, members.E, members.N)
+	case "EC":
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, members.Curve, members.X, members.Y)
+	case "OKP":
+		thumbprint = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, members.Curve, members.X)
+	}
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func thumbprintMembers(key crypto.PublicKey) JSONWebKey {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			KeyType: "RSA",
+			N:       encodeBigInt(key.N),
+			E:       encodeBigInt(big.NewInt(int64(key.E))),
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			KeyType: "EC",
+			Curve:   key.Curve.Params().Name,
+			X:       base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:       base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(key),
+		}
+	}
+	return JSONWebKey{}
+}
+
+// PublicKey parses the key registered by a client, the algorithm has to match
+// the key type.
+func (jwk JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	var key crypto.PublicKey
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, errors.Errorf("unsupported curve %s, only P-256 is supported", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("the EC point is not on the curve")
+		}
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		key = ed25519.PublicKey(x)
+	default:
+		return nil, errors.Errorf("unsupported key type %s", jwk.KeyType)
+	}
+	algorithm, err := AlgorithmOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Algorithm != "" && jwk.Algorithm != algorithm {
+		return nil, errors.Errorf("the algorithm of the %s key is %s, not %s", jwk.KeyType, algorithm, jwk.Algorithm)
+	}
+	return key, nil
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (goRvp *GoRvp) jwksEndpoint(rw http.ResponseWriter, req *http.Request) {
+	// the next key is published before it signs, so caches have it in time
+	keySet := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range goRvp.keyring.ValidationKeys() {
+		keySet.Keys = append(keySet.Keys, NewJSONWebKey(key.Key.Public()))
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(rw).Encode(keySet)
+}
@@ -4,58 +4,100 @@ import (
 	"net/http"
 	"strings"
 	"github.com/ory-am/fosite/token/jwt"
-	core "github.com/ory-am/fosite/handler/oauth2"
 	"fmt"
 	"github.com/ory-am/fosite"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type JwtProxy struct {
-	Strategy  *core.RS256JWTStrategy
+	Sites     Sites
 	Config    *Config
 	Store     *Store
 }
 
-func NewJwtProxy(store *Store, strategy *core.RS256JWTStrategy, config *Config) *JwtProxy {
+func NewJwtProxy(store *Store, sites Sites, config *Config) *JwtProxy {
 	return &JwtProxy{
-		Strategy: strategy,
+		Sites: sites,
 		Config: config,
 		Store: store,
 	}
 }
 
 func (jwtp *JwtProxy) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	handler, found, scopes := matchingServerOf(r.Host, r.URL.String())
+	_, span := startSpan(r.Context(), "gorvp.match_route")
+	handler, found, matched := jwtp.Sites.matchingServerOf(r.Host, r.URL.String())
+	if found {
+		span.SetAttributes(
+			attribute.String("gorvp.route", matched.pattern),
+			attribute.String("gorvp.backend", matched.uri),
+		)
+	}
+	span.End()
 
-	granted := false
 	if found {
+		entry := GetAccessLogEntry(r)
+		if entry != nil {
+			entry.Site = matched.site
+			entry.Route = matched.pattern
+			entry.Backend = matched.uri
+		}
+
+		clientIP := RealIP(r)
+		if !matched.ipFilter.Allowed(clientIP) {
+			WriteRequestError(rw, r, ErrIPNotAllowed)
+			return
+		}
+
 		// scope not defined
+		scopes := matched.scopes
 		if len(scopes) == 0 {
 			handler.ServeHTTP(rw, r)
 			return
 		}
 
-		claims, _, err := GetTokenClaimsFromBearer(jwtp.Store, r)
+		claims, connection, err := GetTokenClaimsFromBearer(jwtp.Store, r)
 		if err != nil {
-			WriteError(rw, err)
+			WriteRequestError(rw, r, err)
+			return
+		}
+		if entry != nil {
+			entry.Subject = claims.Subject
+			entry.ClientID = claims.Audience
+			entry.ConnectionID = connection.ID
+		}
+
+		// check the ip rules of the client which the token is issued to
+		client, err := jwtp.Store.GetRvpClient(claims.Audience)
+		if err != nil {
+			WriteRequestError(rw, r, ErrTokenInvalid)
+			return
+		}
+		if !client.GetIPFilter().Allowed(clientIP) {
+			WriteRequestError(rw, r, ErrIPNotAllowed)
 			return
 		}
 
 		// check grant
-		scopesSlice := GetScopeArgumentFromClaims(claims)
-		for _, requestScope := range scopesSlice {
-			granted = fosite.HierarchicScopeStrategy(scopes, requestScope)
-			if granted {
-				token, _ := GetBearerToken(r)
-				r.Header.Add("Token", token)
-				addTokenClaimHeader(claims, r)
-				handler.ServeHTTP(rw, r)
-				return
+		var grantedScopes []string
+		for _, requestScope := range GetScopeArgumentFromClaims(claims) {
+			if fosite.HierarchicScopeStrategy(scopes, requestScope) {
+				grantedScopes = append(grantedScopes, requestScope)
 			}
 		}
-		WriteError(rw, ErrClientPermission)
+		if len(grantedScopes) == 0 {
+			WriteRequestError(rw, r, ErrClientPermission)
+			return
+		}
+		if entry != nil {
+			entry.Scopes = grantedScopes
+		}
+		token, _ := GetBearerToken(r)
+		r.Header.Add("Token", token)
+		addTokenClaimHeader(claims, r)
+		handler.ServeHTTP(rw, r)
 		return
 	}
-	http.NotFound(rw, r)
+	WriteRequestError(rw, r, ErrRouteNotFound)
 }
 
 func GetBearerToken(r *http.Request) (string, error) {
@@ -0,0 +1,343 @@
+package gorvp
+
+import (
+	"crypto"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jinzhu/gorm"
+)
+
+// states of a signing key
+const (
+	// published in the jwks, not signing yet, so the caches of the backends
+	// have it before it becomes active
+	KeyStateNext    = "next"
+	KeyStateActive  = "active"
+	KeyStateRetired = "retired"
+)
+
+// SigningKey is one key of the keyring. The active key activated last signs
+// the tokens, the other active keys still validate the tokens they signed.
+type SigningKey struct {
+	ID          string    `json:"kid"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatedAt time.Time `json:"activated_at"`
+	// when the key stopped signing
+	RotatedAt  time.Time     `json:"rotated_at"`
+	RetiredAt  time.Time     `json:"retired_at"`
+	PrivateKey string        `json:"private_key,omitempty"`
+	Key        crypto.Signer `json:"-"`
+}
+
+// Algorithm returns the signing algorithm of the key.
+func (key *SigningKey) Algorithm() string {
+	algorithm, _ := AlgorithmOf(key.Key.Public())
+	return algorithm
+}
+
+// Keyring holds the signing keys, it is saved as a json file or in the
+// database, see KeyringDocument.
+type Keyring struct {
+	storage   keyringStorage
+	algorithm string
+	bits      int
+	mutex     sync.RWMutex
+	keys      []*SigningKey
+}
+
+// LoadKeyring reads the keyring of doc, db is only used by the database
+// storage. A new keyring is created if there is none, with importKey as the
+// active key so the issued tokens stay valid. The database keyring imports the
+// keys of the file keyring instead if there is one. New keys are generated
+// with the algorithm of doc.
+func LoadKeyring(doc KeyringDocument, importKey crypto.Signer, db *gorm.DB) (*Keyring, error) {
+	storage, err := newKeyringStorage(doc, db)
+	if err != nil {
+		return nil, err
+	}
+	keyring := &Keyring{
+		storage:   storage,
+		algorithm: doc.Algorithm,
+		bits:      doc.RSABits,
+	}
+	err = keyring.load()
+	if err != errKeyringNotFound {
+		return keyring, err
+	}
+
+	if doc.Storage == KeyringStorageDatabase {
+		file := &fileKeyringStorage{path: doc.Path}
+		if keys, err := file.load(); err == nil {
+			debug("import keyring %s", doc.Path)
+			if err := keyring.setKeys(keys); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if keyring.keys == nil {
+		debug("create keyring")
+		if importKey == nil {
+			if importKey, err = GenerateKey(keyring.algorithm, keyring.bits); err != nil {
+				return nil, err
+			}
+		}
+		active := newSigningKey(importKey, KeyStateActive)
+		active.ActivatedAt = time.Now()
+		keyring.keys = append(keyring.keys, active)
+		if _, err := keyring.addNextKey(); err != nil {
+			return nil, err
+		}
+	}
+	err = keyring.save()
+	if err == errKeyringConflict {
+		// created by another instance in the meantime, its keys are used
+		return keyring, keyring.load()
+	}
+	return keyring, err
+}
+
+func newSigningKey(key crypto.Signer, state string) *SigningKey {
+	return &SigningKey{
+		ID:        KeyID(key.Public()),
+		State:     state,
+		CreatedAt: time.Now(),
+		Key:       key,
+	}
+}
+
+// SigningKey returns the key signing the tokens.
+func (k *Keyring) SigningKey() *SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.signingKey()
+}
+
+func (k *Keyring) signingKey() *SigningKey {
+	var signing *SigningKey
+	for _, key := range k.keys {
+		if key.State == KeyStateActive && (signing == nil || key.ActivatedAt.After(signing.ActivatedAt)) {
+			signing = key
+		}
+	}
+	return signing
+}
+
+// Get returns the key of kid if it is not retired.
+func (k *Keyring) Get(kid string) (*SigningKey, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid && key.State != KeyStateRetired {
+			return key, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// ValidationKeys returns the keys which are not retired, the signing key first.
+func (k *Keyring) ValidationKeys() []*SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	signing := k.signingKey()
+	keys := []*SigningKey{signing}
+	for _, key := range k.keys {
+		if key != signing && key.State != KeyStateRetired {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Keys returns all keys, newest first.
+func (k *Keyring) Keys() []*SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	keys := make([]*SigningKey, len(k.keys))
+	copy(keys, k.keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// Rotate activates the next key, the previous signing key keeps validating
+// its tokens until it is retired. A new next key is generated.
+func (k *Keyring) Rotate() (*SigningKey, error) {
+	k.mutex.Lock()
+	// the keys activated by other processes are kept
+	if err := k.reloadLocked(); err != nil {
+		k.mutex.Unlock()
+		return nil, err
+	}
+	now := time.Now()
+	var next *SigningKey
+	for _, key := range k.keys {
+		if key.State == KeyStateNext {
+			next = key
+		}
+	}
+	if next == nil {
+		var err error
+		if next, err = k.addNextKey(); err != nil {
+			k.mutex.Unlock()
+			return nil, err
+		}
+	}
+	if previous := k.signingKey(); previous != nil {
+		previous.RotatedAt = now
+	}
+	next.State = KeyStateActive
+	next.ActivatedAt = now
+	if _, err := k.addNextKey(); err != nil {
+		k.mutex.Unlock()
+		return nil, err
+	}
+	err := k.commit()
+	k.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Retire stops the key of kid from validating tokens.
+func (k *Keyring) Retire(kid string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if err := k.reloadLocked(); err != nil {
+		return err
+	}
+	for _, key := range k.keys {
+		if key.ID != kid || key.State == KeyStateRetired {
+			continue
+		}
+		if key == k.signingKey() {
+			return ErrRetireSigningKey
+		}
+		key.State = KeyStateRetired
+		key.RetiredAt = time.Now()
+		return k.commit()
+	}
+	return ErrKeyNotFound
+}
+
+// Maintain rotates the signing key when it is older than rotationPeriod and
+// retires the keys which stopped signing more than retireAfter ago, a zero
+// duration disables either. Changes made by other processes are loaded first.
+func (k *Keyring) Maintain(rotationPeriod, retireAfter time.Duration) error {
+	err := k.reload()
+	if err != nil {
+		return err
+	}
+
+	signing := k.SigningKey()
+	if rotationPeriod > 0 && time.Since(signing.ActivatedAt) >= rotationPeriod {
+		debug("rotate signing key %s", signing.ID)
+		if _, err := k.Rotate(); err != nil {
+			if err == errKeyringConflict {
+				// rotated by another instance, the keyring is loaded again
+				return nil
+			}
+			return err
+		}
+	}
+	if retireAfter > 0 {
+		for _, key := range k.ValidationKeys() {
+			if key.State == KeyStateActive && !key.RotatedAt.IsZero() && time.Since(key.RotatedAt) >= retireAfter {
+				debug("retire signing key %s", key.ID)
+				if err := k.Retire(key.ID); err != nil && err != errKeyringConflict {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addNextKey generates a key in the next state.
+func (k *Keyring) addNextKey() (*SigningKey, error) {
+	privateKey, err := GenerateKey(k.algorithm, k.bits)
+	if err != nil {
+		return nil, err
+	}
+	next := newSigningKey(privateKey, KeyStateNext)
+	k.keys = append(k.keys, next)
+	return next, nil
+}
+
+// reload loads the keyring again if it was saved by another process.
+func (k *Keyring) reload() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.reloadLocked()
+}
+
+func (k *Keyring) reloadLocked() error {
+	changed, err := k.storage.changed()
+	if err != nil || !changed {
+		return err
+	}
+	return k.load()
+}
+
+func (k *Keyring) load() error {
+	keys, err := k.storage.load()
+	if err != nil {
+		return err
+	}
+	return k.setKeys(keys)
+}
+
+// setKeys parses the private keys of keys, retired keys have none.
+func (k *Keyring) setKeys(keys []*SigningKey) error {
+	var err error
+	for _, key := range keys {
+		if key.State == KeyStateRetired {
+			continue
+		}
+		key.Key, err = ParsePrivateKey([]byte(key.PrivateKey), "")
+		if err != nil {
+			return errors.Errorf("keyring: key %s: %s", key.ID, err)
+		}
+	}
+	k.keys = keys
+	if k.signingKey() == nil {
+		return errors.New("keyring: there is no active key")
+	}
+	return nil
+}
+
+func (k *Keyring) save() error {
+	for _, key := range k.keys {
+		if key.State == KeyStateRetired {
+			// the private key is not needed anymore
+			key.PrivateKey = ""
+			continue
+		}
+		if key.PrivateKey == "" {
+			privateKey, err := MarshalPrivateKey(key.Key)
+			if err != nil {
+				return err
+			}
+			key.PrivateKey = string(privateKey)
+		}
+	}
+	return k.storage.save(k.keys)
+}
+
+// commit saves the changed keys, they are loaded again if the save failed so
+// the keyring stays the same as the saved one.
+func (k *Keyring) commit() error {
+	err := k.save()
+	if err != nil {
+		if loadErr := k.load(); loadErr != nil {
+			log.Printf("keyring: %s", loadErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,327 @@
+package gorvp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jinzhu/gorm"
+)
+
+// storages of the keyring
+const (
+	KeyringStorageFile     = "file"
+	KeyringStorageDatabase = "database"
+)
+
+// MasterKeyEnv holds the master key of the database keyring, it takes
+// precedence over keyring.master_key_file.
+const MasterKeyEnv = "GORVP_KEYRING_MASTER_KEY"
+
+var (
+	errKeyringNotFound = errors.New("keyring: not created yet")
+	errKeyringConflict = errors.New("keyring: saved by another process in the meantime")
+)
+
+// keyringStorage keeps the keys of a keyring, shared by the processes using it.
+type keyringStorage interface {
+	// load returns the saved keys, errKeyringNotFound if there are none yet
+	load() ([]*SigningKey, error)
+	// changed reports whether another process saved the keys since the last load or save
+	changed() (bool, error)
+	// save replaces the saved keys, errKeyringConflict if another process saved them first
+	save(keys []*SigningKey) error
+}
+
+func newKeyringStorage(doc KeyringDocument, db *gorm.DB) (keyringStorage, error) {
+	switch doc.Storage {
+	case KeyringStorageFile, "":
+		return &fileKeyringStorage{path: doc.Path}, nil
+	case KeyringStorageDatabase:
+		masterKey, err := loadMasterKey(doc.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &databaseKeyringStorage{db: db, masterKey: masterKey}, nil
+	}
+	return nil, errors.Errorf("unknown keyring storage %q", doc.Storage)
+}
+
+type keyringFile struct {
+	Keys []*SigningKey `json:"keys"`
+}
+
+// fileKeyringStorage saves the keys as a json file, the private keys in plain
+// text, so the file is only readable by its owner. The changes of other
+// processes are detected by the content, the modification time may be the
+// same for two saves.
+type fileKeyringStorage struct {
+	path string
+	sum  [sha256.Size]byte
+}
+
+// read returns the content of the keyring file and its checksum.
+func (s *fileKeyringStorage) read() ([]byte, [sha256.Size]byte, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	return content, sha256.Sum256(content), nil
+}
+
+func (s *fileKeyringStorage) load() ([]*SigningKey, error) {
+	content, sum, err := s.read()
+	if os.IsNotExist(err) {
+		return nil, errKeyringNotFound
+	}
+	if err != nil {
+		return nil, errors.Errorf("can not read keyring: %s", err)
+	}
+	file := &keyringFile{}
+	err = json.Unmarshal(content, file)
+	if err != nil {
+		return nil, errors.Errorf("can not parse keyring: %s", err)
+	}
+	s.sum = sum
+	return file.Keys, nil
+}
+
+func (s *fileKeyringStorage) changed() (bool, error) {
+	_, sum, err := s.read()
+	if err != nil {
+		return false, err
+	}
+	return sum != s.sum, nil
+}
+
+func (s *fileKeyringStorage) save(keys []*SigningKey) error {
+	// the file was replaced since it was loaded, the keys of the other
+	// process would be overwritten
+	_, sum, err := s.read()
+	if err == nil && sum != s.sum {
+		return errKeyringConflict
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("can not read keyring: %s", err)
+	}
+
+	content, err := json.MarshalIndent(&keyringFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file at once, another process may read it
+	os.MkdirAll(filepath.Dir(s.path), 0755)
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return errors.Errorf("can not write keyring: %s", err)
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return errors.Errorf("can not write keyring: %s", err)
+	}
+	s.sum = sha256.Sum256(content)
+	return nil
+}
+
+// KeyringVersion is incremented by every save of the database keyring, a
+// save based on an older version is rejected.
+type KeyringVersion struct {
+	// there is a single row
+	ID      int `gorm:"primary_key"`
+	Version int64
+}
+
+func (v *KeyringVersion) TableName() string {
+	return "oauth_keyring"
+}
+
+// SigningKeyRecord is a key of the database keyring.
+type SigningKeyRecord struct {
+	ID          string `gorm:"primary_key"`
+	State       string
+	CreatedAt   time.Time
+	ActivatedAt time.Time
+	RotatedAt   time.Time
+	RetiredAt   time.Time
+	// the PEM sealed with the master key, empty once retired
+	PrivateKey string `gorm:"size:8191"`
+}
+
+func (r *SigningKeyRecord) TableName() string {
+	return "oauth_signing_keys"
+}
+
+const keyringVersionID = 1
+
+// databaseKeyringStorage saves the keys in the database shared by all
+// instances, the private keys are encrypted with the master key.
+type databaseKeyringStorage struct {
+	db        *gorm.DB
+	masterKey cipher.AEAD
+	version   int64
+}
+
+func (s *databaseKeyringStorage) load() ([]*SigningKey, error) {
+	version := &KeyringVersion{}
+	err := s.db.Where("id = ?", keyringVersionID).First(version).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errKeyringNotFound
+	}
+	if err != nil {
+		return nil, errors.Errorf("can not read keyring: %s", err)
+	}
+	var records []SigningKeyRecord
+	if err := s.db.Find(&records).Error; err != nil {
+		return nil, errors.Errorf("can not read keyring: %s", err)
+	}
+
+	keys := []*SigningKey{}
+	for _, record := range records {
+		key := &SigningKey{
+			ID:          record.ID,
+			State:       record.State,
+			CreatedAt:   record.CreatedAt,
+			ActivatedAt: record.ActivatedAt,
+			RotatedAt:   record.RotatedAt,
+			RetiredAt:   record.RetiredAt,
+		}
+		if record.PrivateKey != "" {
+			privateKey, err := s.open(record.ID, record.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			key.PrivateKey = string(privateKey)
+		}
+		keys = append(keys, key)
+	}
+	s.version = version.Version
+	return keys, nil
+}
+
+func (s *databaseKeyringStorage) changed() (bool, error) {
+	version := &KeyringVersion{}
+	err := s.db.Where("id = ?", keyringVersionID).First(version).Error
+	if err != nil {
+		return false, err
+	}
+	return version.Version != s.version, nil
+}
+
+func (s *databaseKeyringStorage) save(keys []*SigningKey) error {
+	records := []SigningKeyRecord{}
+	for _, key := range keys {
+		record := SigningKeyRecord{
+			ID:          key.ID,
+			State:       key.State,
+			CreatedAt:   key.CreatedAt,
+			ActivatedAt: key.ActivatedAt,
+			RotatedAt:   key.RotatedAt,
+			RetiredAt:   key.RetiredAt,
+		}
+		if key.PrivateKey != "" {
+			sealed, err := s.seal(key.ID, []byte(key.PrivateKey))
+			if err != nil {
+				return err
+			}
+			record.PrivateKey = sealed
+		}
+		records = append(records, record)
+	}
+
+	tx := s.db.Begin()
+	if s.version == 0 {
+		// the first instance creating the keyring wins
+		if err := tx.Create(&KeyringVersion{ID: keyringVersionID, Version: 1}).Error; err != nil {
+			tx.Rollback()
+			return errKeyringConflict
+		}
+	} else {
+		result := tx.Model(&KeyringVersion{}).
+			Where("id = ? AND version = ?", keyringVersionID, s.version).
+			Update("version", s.version+1)
+		if result.Error != nil {
+			tx.Rollback()
+			return errors.Errorf("can not write keyring: %s", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			tx.Rollback()
+			return errKeyringConflict
+		}
+	}
+	if err := tx.Delete(&SigningKeyRecord{}).Error; err != nil {
+		tx.Rollback()
+		return errors.Errorf("can not write keyring: %s", err)
+	}
+	for i := range records {
+		if err := tx.Create(&records[i]).Error; err != nil {
+			tx.Rollback()
+			return errors.Errorf("can not write keyring: %s", err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Errorf("can not write keyring: %s", err)
+	}
+	s.version++
+	return nil
+}
+
+// seal encrypts the private key of kid, the kid is authenticated as well so
+// the sealed keys can not be swapped.
+func (s *databaseKeyringStorage) seal(kid string, privateKey []byte) (string, error) {
+	nonce := make([]byte, s.masterKey.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := s.masterKey.Seal(nonce, nonce, privateKey, []byte(kid))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *databaseKeyringStorage) open(kid string, sealed string) ([]byte, error) {
+	content, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(content) < s.masterKey.NonceSize() {
+		return nil, errors.Errorf("keyring: key %s is malformed", kid)
+	}
+	nonce, content := content[:s.masterKey.NonceSize()], content[s.masterKey.NonceSize():]
+	privateKey, err := s.masterKey.Open(nil, nonce, content, []byte(kid))
+	if err != nil {
+		return nil, errors.Errorf("keyring: can not decrypt key %s, is the master key right?", kid)
+	}
+	return privateKey, nil
+}
+
+// loadMasterKey reads the base64 encoded AES-256 master key from MasterKeyEnv
+// or path.
+func loadMasterKey(path string) (cipher.AEAD, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if encoded == "" && path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Errorf("can not read master key: %s", err)
+		}
+		encoded = string(content)
+	}
+	if encoded == "" {
+		return nil, errors.Errorf("the database keyring needs a master key, set %s or keyring.master_key_file", MasterKeyEnv)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the master key must be 32 random bytes encoded in base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
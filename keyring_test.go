@@ -0,0 +1,187 @@
+package gorvp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestKeyringDocument returns a file keyring in a temporary directory,
+// with ES256 keys which are generated quickly.
+func newTestKeyringDocument(t *testing.T) KeyringDocument {
+	return KeyringDocument{
+		Path:      filepath.Join(t.TempDir(), "keyring.json"),
+		Algorithm: AlgorithmES256,
+	}
+}
+
+func loadTestKeyring(t *testing.T, doc KeyringDocument) *Keyring {
+	keyring, err := LoadKeyring(doc, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// keyStates returns the state of every key by its kid.
+func keyStates(keyring *Keyring) map[string]string {
+	states := map[string]string{}
+	for _, key := range keyring.Keys() {
+		states[key.ID] = key.State
+	}
+	return states
+}
+
+func TestLoadKeyring(t *testing.T) {
+	doc := newTestKeyringDocument(t)
+	importKey, err := GenerateKey(AlgorithmES256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(doc, importKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the imported key keeps signing, the next one is published already
+	signing := keyring.SigningKey()
+	if signing.ID != KeyID(importKey.Public()) {
+		t.Errorf("expected the imported key to sign, got %s", signing.ID)
+	}
+	states := keyStates(keyring)
+	if len(states) != 2 {
+		t.Fatalf("expected an active and a next key, got %v", states)
+	}
+	info, err := os.Stat(doc.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the keyring is readable by others: %s", info.Mode())
+	}
+
+	loaded := loadTestKeyring(t, doc)
+	if loaded.SigningKey().ID != signing.ID {
+		t.Errorf("expected the saved signing key %s, got %s", signing.ID, loaded.SigningKey().ID)
+	}
+	for kid, state := range keyStates(loaded) {
+		if states[kid] != state {
+			t.Errorf("key %s: expected %s, got %s", kid, states[kid], state)
+		}
+	}
+}
+
+func TestKeyringRotate(t *testing.T) {
+	keyring := loadTestKeyring(t, newTestKeyringDocument(t))
+	previous := keyring.SigningKey()
+	var next string
+	for kid, state := range keyStates(keyring) {
+		if state == KeyStateNext {
+			next = kid
+		}
+	}
+
+	activated, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activated.ID != next || keyring.SigningKey().ID != next {
+		t.Errorf("expected the next key %s to sign", next)
+	}
+	if _, err := keyring.Get(previous.ID); err != nil {
+		t.Errorf("the previous key does not validate its tokens: %s", err)
+	}
+	if previous.RotatedAt.IsZero() {
+		t.Error("the rotation time of the previous key is not set")
+	}
+	if len(keyring.ValidationKeys()) != 3 || keyring.ValidationKeys()[0].ID != next {
+		t.Errorf("expected the signing key first of 3 validation keys")
+	}
+}
+
+func TestKeyringRetire(t *testing.T) {
+	doc := newTestKeyringDocument(t)
+	keyring := loadTestKeyring(t, doc)
+	previous := keyring.SigningKey()
+	if err := keyring.Retire(previous.ID); err != ErrRetireSigningKey {
+		t.Errorf("expected the signing key not to be retired, got %v", err)
+	}
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keyring.Retire(previous.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Get(previous.ID); err != ErrKeyNotFound {
+		t.Errorf("expected the retired key not to be found, got %v", err)
+	}
+	if err := keyring.Retire("unknown"); err != ErrKeyNotFound {
+		t.Errorf("expected an unknown key not to be found, got %v", err)
+	}
+
+	// the private key of the retired key is not saved
+	for _, key := range loadTestKeyring(t, doc).Keys() {
+		if key.ID == previous.ID && (key.State != KeyStateRetired || key.PrivateKey != "") {
+			t.Errorf("the retired key is saved as %s with its private key", key.State)
+		}
+	}
+}
+
+func TestKeyringRotateReloads(t *testing.T) {
+	doc := newTestKeyringDocument(t)
+	first := loadTestKeyring(t, doc)
+	second := loadTestKeyring(t, doc)
+
+	rotated, err := first.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second process loads the rotation of the first one before its own
+	activated, err := second.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := keyStates(second)
+	if states[rotated.ID] != KeyStateActive || activated.ID == rotated.ID {
+		t.Errorf("the key activated by the other process is lost: %v", states)
+	}
+	if len(states) != 4 {
+		t.Errorf("expected 3 active keys and a next key, got %v", states)
+	}
+
+	if err := first.Retire(rotated.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Get(activated.ID); err != nil {
+		t.Errorf("the key activated by the other process is lost: %s", err)
+	}
+}
+
+func TestFileKeyringStorageConflict(t *testing.T) {
+	doc := newTestKeyringDocument(t)
+	keys := loadTestKeyring(t, doc).Keys()
+
+	first := &fileKeyringStorage{path: doc.Path}
+	second := &fileKeyringStorage{path: doc.Path}
+	if _, err := first.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first process saves other keys
+	if err := first.save(keys[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := second.changed(); err != nil || !changed {
+		t.Errorf("expected the keyring to be changed, got %t %v", changed, err)
+	}
+	if err := second.save(keys); err != errKeyringConflict {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+	if changed, err := first.changed(); err != nil || changed {
+		t.Errorf("expected the keyring saved last to be unchanged, got %t %v", changed, err)
+	}
+}
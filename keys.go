@@ -0,0 +1,183 @@
+package gorvp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/youmark/pkcs8"
+)
+
+// signing algorithms of the tokens
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+const minRSAKeyBits = 2048
+
+// GenerateKey generates a private key for algorithm, bits is only used for RSA.
+func GenerateKey(algorithm string, bits int) (crypto.Signer, error) {
+	switch algorithm {
+	case AlgorithmRS256, "":
+		if bits == 0 {
+			bits = minRSAKeyBits
+		}
+		if bits < minRSAKeyBits {
+			return nil, errors.Errorf("rsa keys need at least %d bits, got %d", minRSAKeyBits, bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case AlgorithmES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgorithmEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, errors.Errorf("unsupported signing algorithm %q", algorithm)
+}
+
+// ParsePrivateKey reads a PEM-encoded PKCS#1, SEC 1 or PKCS#8 private key,
+// encrypted ones are decrypted with passphrase.
+func ParsePrivateKey(pemData []byte, passphrase string) (crypto.Signer, error) {
+	pemBlock, _ := pem.Decode(pemData)
+	if pemBlock == nil {
+		return nil, errors.New("bad key data: not PEM-encoded")
+	}
+
+	der := pemBlock.Bytes
+	if x509.IsEncryptedPEMBlock(pemBlock) {
+		if passphrase == "" {
+			return nil, errors.New("the key is encrypted, a passphrase is needed")
+		}
+		var err error
+		der, err = x509.DecryptPEMBlock(pemBlock, []byte(passphrase))
+		if err != nil {
+			return nil, errors.Errorf("can not decrypt key: %s", err)
+		}
+	}
+
+	var key interface{}
+	var err error
+	switch pemBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == "" {
+			return nil, errors.New("the key is encrypted, a passphrase is needed")
+		}
+		key, err = pkcs8.ParsePKCS8PrivateKey(der, []byte(passphrase))
+	default:
+		return nil, errors.Errorf("unknown key type %q", pemBlock.Type)
+	}
+	if err != nil {
+		return nil, errors.Errorf("bad private key: %s", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key %T", key)
+	}
+	if _, err := AlgorithmOf(signer.Public()); err != nil {
+		return nil, err
+	}
+	if rsaKey, ok := signer.Public().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+		// still loaded, the tokens it signed stay valid until it is rotated
+		log.Printf("the %d bits rsa key is weaker than recommended, rotate it to a key of %d bits or more", rsaKey.N.BitLen(), minRSAKeyBits)
+	}
+	return signer, nil
+}
+
+// MarshalPrivateKey encodes key as PKCS#8 PEM.
+func MarshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKey encodes the public part of key as PKIX PEM.
+func MarshalPublicKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// AlgorithmOf returns the signing algorithm of the public key.
+func AlgorithmOf(key crypto.PublicKey) (string, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return AlgorithmRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", errors.Errorf("unsupported curve %s, only P-256 is supported", key.Curve.Params().Name)
+		}
+		return AlgorithmES256, nil
+	case ed25519.PublicKey:
+		return AlgorithmEdDSA, nil
+	}
+	return "", errors.Errorf("unsupported key %T", key)
+}
+
+func signingMethodOf(algorithm string) jwtgo.SigningMethod {
+	switch algorithm {
+	case AlgorithmES256:
+		return jwtgo.SigningMethodES256
+	case AlgorithmEdDSA:
+		return SigningMethodEdDSA
+	}
+	return jwtgo.SigningMethodRS256
+}
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys (RFC 8037).
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwtgo.RegisterSigningMethod(AlgorithmEdDSA, func() jwtgo.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgorithmEdDSA
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwtgo.ErrInvalidKey
+	}
+	return jwtgo.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwtgo.ErrInvalidKey
+	}
+	sig, err := jwtgo.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwtgo.ErrSignatureInvalid
+	}
+	return nil
+}
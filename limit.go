@@ -0,0 +1,76 @@
+package gorvp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// BodyLimit rejects request bodies larger than MaxBodySize with 413 and,
+// if Buffer is set, reads the whole body before passing the request on,
+// so slow uploads never reach the backend.
+type BodyLimit struct {
+	MaxBodySize int64
+	Buffer      bool
+}
+
+func NewBodyLimit(maxBodySize int64, buffer bool) *BodyLimit {
+	return &BodyLimit{
+		MaxBodySize: maxBodySize,
+		Buffer:      buffer,
+	}
+}
+
+// ServeHTTP makes BodyLimit usable as a negroni middleware.
+func (bl *BodyLimit) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if bl.limit(rw, r) {
+		next(rw, r)
+	}
+}
+
+// Handler wraps a single backend handler, used for per route limits.
+func (bl *BodyLimit) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if bl.limit(rw, r) {
+			h.ServeHTTP(rw, r)
+		}
+	})
+}
+
+func (bl *BodyLimit) limit(rw http.ResponseWriter, r *http.Request) bool {
+	if bl.MaxBodySize > 0 {
+		if r.ContentLength > bl.MaxBodySize {
+			WriteRequestError(rw, r, ErrRequestEntityTooLarge)
+			return false
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, bl.MaxBodySize)
+	}
+
+	if !bl.Buffer {
+		return true
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		if IsBodyTooLarge(err) {
+			WriteRequestError(rw, r, ErrRequestEntityTooLarge)
+		} else {
+			WriteRequestError(rw, r, ErrInvalidRequest)
+		}
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	return true
+}
+
+// IsBodyTooLarge reports whether err comes from reading past the limit set
+// by BodyLimit.
+func IsBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
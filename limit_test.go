@@ -0,0 +1,69 @@
+package gorvp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newLimitRequest returns a request with a body of size bytes, chunked bodies
+// have no Content-Length.
+func newLimitRequest(size int, chunked bool) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("a", size)))
+	if chunked {
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+	}
+	return r
+}
+
+func TestBodyLimit(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		size    int
+		chunked bool
+		buffer  bool
+		status  int
+	}{
+		{"within the limit", 10, false, false, http.StatusOK},
+		{"over the limit", 11, false, false, http.StatusRequestEntityTooLarge},
+		{"chunked within the limit", 10, true, false, http.StatusOK},
+		// the backend reads past the limit
+		{"chunked over the limit", 11, true, false, http.StatusRequestEntityTooLarge},
+		{"buffered within the limit", 10, false, true, http.StatusOK},
+		{"buffered over the limit", 11, false, true, http.StatusRequestEntityTooLarge},
+		{"buffered chunked within the limit", 10, true, true, http.StatusOK},
+		{"buffered chunked over the limit", 11, true, true, http.StatusRequestEntityTooLarge},
+	} {
+		var reached bool
+		backend := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			reached = true
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				if !IsBodyTooLarge(err) {
+					t.Errorf("%s: unexpected error %s", c.name, err)
+				}
+				WriteRequestError(rw, r, ErrRequestEntityTooLarge)
+				return
+			}
+			if len(body) != c.size {
+				t.Errorf("%s: expected a body of %d bytes, got %d", c.name, c.size, len(body))
+			}
+			if c.buffer && (r.ContentLength != int64(c.size) || r.TransferEncoding != nil) {
+				t.Errorf("%s: the buffered body is sent with length %d and %v", c.name, r.ContentLength, r.TransferEncoding)
+			}
+		})
+
+		rw := httptest.NewRecorder()
+		NewBodyLimit(10, c.buffer).Handler(backend).ServeHTTP(rw, newLimitRequest(c.size, c.chunked))
+		if rw.Code != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, rw.Code)
+		}
+		// only streamed bodies without a length reach the backend past the limit
+		if expected := c.status == http.StatusOK || (c.chunked && !c.buffer); reached != expected {
+			t.Errorf("%s: expected the backend to be reached %t, got %t", c.name, expected, reached)
+		}
+	}
+}
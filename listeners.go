@@ -0,0 +1,161 @@
+package gorvp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/gorilla/mux"
+)
+
+// components which can be bound to listeners
+const (
+	ComponentAdmin       = "admin"
+	ComponentConnections = "connections"
+	ComponentOAuth2      = "oauth2"
+	ComponentMetrics     = "metrics"
+	ComponentFrontend    = "frontend"
+	// routes added to GoRvp.Router by the program embedding gorvp
+	ComponentCustom = "custom"
+)
+
+const defaultListenerName = "default"
+
+// Listener is one address gorvp listens on, with its own router.
+type Listener struct {
+	Name string
+	ListenerDocument
+	Router  *mux.Router
+	handler http.Handler
+}
+
+// setupListeners creates the configured listeners, or a single listener on
+// the port flag serving GoRvp.Router if there is none.
+func (goRvp *GoRvp) setupListeners() {
+	if len(goRvp.Config.Listeners) == 0 {
+		goRvp.listeners = []*Listener{{
+			Name:             defaultListenerName,
+			ListenerDocument: ListenerDocument{Address: ":" + goRvp.Config.Port},
+			Router:           goRvp.Router,
+		}}
+		return
+	}
+
+	// sorted, so the order of the inherited sockets is stable across upgrades
+	names := make([]string, 0, len(goRvp.Config.Listeners))
+	for name := range goRvp.Config.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	goRvp.listeners = nil
+	for _, name := range names {
+		listener := &Listener{
+			Name:             name,
+			ListenerDocument: goRvp.Config.Listeners[name],
+			Router:           mux.NewRouter(),
+		}
+		goRvp.listeners = append(goRvp.listeners, listener)
+	}
+
+	// custom routes are the fallback of the listeners they are bound to
+	for _, listener := range goRvp.boundListeners(ComponentCustom, nil) {
+		listener.Router.NotFoundHandler = goRvp.Router
+	}
+}
+
+// boundListeners returns the listeners named in bind, every listener if bind is
+// empty. The admin API, the connections and the metrics are only served on the
+// listeners named, so they are never exposed on a public listener by default.
+func (goRvp *GoRvp) boundListeners(component string, bind []string) []*Listener {
+	if bind == nil {
+		bind = goRvp.Config.Bind.For(component)
+	}
+	if len(bind) == 0 {
+		if len(goRvp.Config.Listeners) > 0 && (component == ComponentAdmin || component == ComponentConnections || component == ComponentMetrics) {
+			return nil
+		}
+		return goRvp.listeners
+	}
+	var listeners []*Listener
+	for _, listener := range goRvp.listeners {
+		for _, name := range bind {
+			if listener.Name == name {
+				listeners = append(listeners, listener)
+			}
+		}
+	}
+	return listeners
+}
+
+// mount calls setup with the router of every listener the component is bound to.
+func (goRvp *GoRvp) mount(component string, setup func(router *mux.Router)) {
+	for _, listener := range goRvp.boundListeners(component, nil) {
+		setup(listener.Router)
+	}
+}
+
+// oauth2TokenEndpoint is the url owner clients use to reach the token endpoint,
+// on oauth2_internal_url or else on the first oauth2 listener without tls, the
+// config is rejected if there is none.
+func (goRvp *GoRvp) oauth2TokenEndpoint() string {
+	if goRvp.Config.Oauth2InternalURL != "" {
+		return strings.TrimSuffix(goRvp.Config.Oauth2InternalURL, "/") + goRvp.Config.Oauth2TokenMountPoint
+	}
+	for _, listener := range goRvp.boundListeners(ComponentOAuth2, nil) {
+		if listener.TLS.Cert != "" {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(listener.Address)
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, port), goRvp.Config.Oauth2TokenMountPoint)
+	}
+	return fmt.Sprintf("http://127.0.0.1:%s%s", goRvp.Config.Port, goRvp.Config.Oauth2TokenMountPoint)
+}
+
+func (listener *Listener) tlsConfig() (*tls.Config, error) {
+	if listener.TLS.Cert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(listener.TLS.Cert, listener.TLS.Key)
+	if err != nil {
+		return nil, errors.Errorf("listener %s: %s", listener.Name, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}, nil
+}
+
+// AllowedHosts is a negroni middleware rejecting requests for other hosts
+// than the ones a listener serves.
+type AllowedHosts []string
+
+func (hosts AllowedHosts) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(hosts) == 0 || hosts.allowed(r.Host) {
+		next(rw, r)
+		return
+	}
+	WriteRequestError(rw, r, ErrRouteNotFound)
+}
+
+func (hosts AllowedHosts) allowed(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.ToLower(strings.Trim(hostname, "[]"))
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == hostname || allowed == "*" {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(hostname, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
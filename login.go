@@ -0,0 +1,408 @@
+package gorvp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	"github.com/ory-am/fosite"
+	pkgerrors "github.com/pkg/errors"
+)
+
+const (
+	loginCookieName = "gorvp_login"
+	csrfCookieName  = "gorvp_csrf"
+	csrfFormField   = "csrf_token"
+	// typ claim of the login cookie, so no other token signed by the keyring is taken for a login
+	loginTokenType = "login"
+)
+
+// LoginPages renders the login and consent pages of the authorize endpoint.
+type LoginPages struct {
+	Login   *htmltemplate.Template
+	Consent *htmltemplate.Template
+	Device  *htmltemplate.Template
+}
+
+// LoginPageData is passed to the login template.
+type LoginPageData struct {
+	Action    string
+	ReturnTo  string
+	CSRFToken string
+	Username  string
+	Error     string
+}
+
+// ConsentPageData is passed to the consent template.
+type ConsentPageData struct {
+	Action    string
+	CSRFToken string
+	// the parameters of the authorize request, posted back with the decision
+	Params     url.Values
+	ClientID   string
+	ClientName string
+	Subject    string
+	Scopes     []ConsentScope
+}
+
+// ConsentScope is a scope the user is asked for, required scopes can not be
+// deselected.
+type ConsentScope struct {
+	Name        string
+	DisplayName string
+	Description string
+	Required    bool
+}
+
+// LoginSession is the user logged in on the login page.
+type LoginSession struct {
+	Subject  string
+	AuthTime time.Time
+}
+
+// NewLoginPages parses the templates of doc, the built-in ones are used for
+// the templates which are not configured.
+func NewLoginPages(doc LoginDocument) (*LoginPages, error) {
+	login, err := parseLoginTemplate("login", doc.LoginTemplate, defaultLoginTemplate)
+	if err != nil {
+		return nil, err
+	}
+	consent, err := parseLoginTemplate("consent", doc.ConsentTemplate, defaultConsentTemplate)
+	if err != nil {
+		return nil, err
+	}
+	device, err := parseLoginTemplate("device", doc.DeviceTemplate, defaultDeviceTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginPages{Login: login, Consent: consent, Device: device}, nil
+}
+
+func parseLoginTemplate(name string, path string, builtin string) (*htmltemplate.Template, error) {
+	if path == "" {
+		return htmltemplate.New(name).Parse(builtin)
+	}
+	t, err := htmltemplate.New(filepath.Base(path)).ParseFiles(path)
+	if err != nil {
+		return nil, errors.Errorf("login %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+func (pages *LoginPages) render(rw http.ResponseWriter, tmpl *htmltemplate.Template, statusCode int, data interface{}) {
+	body := &bytes.Buffer{}
+	if err := tmpl.Execute(body, data); err != nil {
+		debug("can not render login page: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	rw.Header().Set("Cache-Control", "no-store")
+	// the pages must not be framed by other sites
+	rw.Header().Set("X-Frame-Options", "DENY")
+	rw.WriteHeader(statusCode)
+	rw.Write(body.Bytes())
+}
+
+func (goRvp *GoRvp) loginEndpoint(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	returnTo := req.Form.Get("return_to")
+	if !goRvp.validReturnTo(returnTo) {
+		WriteRequestError(rw, req, ErrInvalidRequest)
+		return
+	}
+	data := &LoginPageData{
+		Action:    goRvp.Config.Login.MountPoint,
+		ReturnTo:  returnTo,
+		CSRFToken: csrfTokenOf(rw, req),
+	}
+	if req.Method != http.MethodPost {
+		goRvp.loginPages.render(rw, goRvp.loginPages.Login, http.StatusOK, data)
+		return
+	}
+
+	if !validCSRFToken(req) {
+		WriteRequestError(rw, req, ErrInvalidRequest)
+		return
+	}
+	if goRvp.store.OC == nil {
+		WriteRequestError(rw, req, ErrServerError)
+		return
+	}
+	data.Username = req.PostForm.Get("username")
+	err := goRvp.store.OC.Authenticate(req.Context(), data.Username, req.PostForm.Get("password"))
+	if err != nil {
+		data.Error = "Wrong username or password."
+		goRvp.loginPages.render(rw, goRvp.loginPages.Login, http.StatusUnauthorized, data)
+		return
+	}
+
+	if err := goRvp.setLoginSession(rw, req, data.Username); err != nil {
+		WriteRequestError(rw, req, ErrServerError)
+		return
+	}
+	if entry := GetAccessLogEntry(req); entry != nil {
+		entry.Subject = data.Username
+	}
+	http.Redirect(rw, req, returnTo, http.StatusSeeOther)
+}
+
+// validReturnTo only lets the login page return to the authorize endpoint or
+// the device verification page.
+func (goRvp *GoRvp) validReturnTo(returnTo string) bool {
+	uri, err := url.Parse(returnTo)
+	if err != nil || uri.Scheme != "" || uri.Host != "" || strings.HasPrefix(returnTo, "//") {
+		return false
+	}
+	return uri.Path == goRvp.Config.Oauth2AuthMountPoint ||
+		uri.Path == goRvp.Config.DeviceVerificationMountPoint
+}
+
+// redirectToLogin sends the browser to the login page, which returns to the
+// authorize request once the user logged in.
+func (goRvp *GoRvp) redirectToLogin(rw http.ResponseWriter, req *http.Request) {
+	returnTo := req.URL.Path
+	if req.Method == http.MethodGet && req.URL.RawQuery != "" {
+		returnTo += "?" + req.URL.RawQuery
+	} else if query := req.Form.Encode(); query != "" {
+		returnTo += "?" + query
+	}
+	login := goRvp.Config.Login.MountPoint + "?" + url.Values{"return_to": {returnTo}}.Encode()
+	http.Redirect(rw, req, login, http.StatusFound)
+}
+
+// setLoginSession sets the login cookie, a token signed by the keyring.
+func (goRvp *GoRvp) setLoginSession(rw http.ResponseWriter, req *http.Request, subject string) error {
+	now := time.Now()
+	expiresAt := now.Add(goRvp.Config.Login.Lifespan * time.Second)
+	token, _, err := goRvp.store.TokenStrategy.sign(jwtgo.MapClaims{
+		"typ": loginTokenType,
+		"iss": goRvp.Config.Issuer,
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": expiresAt.Unix(),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   GetForwardedInfo(req).Proto == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// loginSessionOf returns the user of the login cookie, nil if there is none
+// or it expired.
+func (goRvp *GoRvp) loginSessionOf(req *http.Request) *LoginSession {
+	cookie, err := req.Cookie(loginCookieName)
+	if err != nil {
+		return nil
+	}
+	token, err := goRvp.store.TokenStrategy.Decode(cookie.Value)
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims, ok := token.Claims.(jwtgo.MapClaims)
+	if !ok || claims["typ"] != loginTokenType {
+		return nil
+	}
+	subject, _ := claims["sub"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	if subject == "" {
+		return nil
+	}
+	return &LoginSession{Subject: subject, AuthTime: time.Unix(int64(issuedAt), 0)}
+}
+
+// consent asks the user to grant the scopes which are not in the connection of
+// the client yet. It returns true once they are granted, the optional scopes
+// the user deselected are not granted. Otherwise the response has been written.
+func (goRvp *GoRvp) consent(rw http.ResponseWriter, req *http.Request, ar fosite.AuthorizeRequester, subject string) bool {
+	client := ar.GetClient().(Client)
+	granted := map[string]bool{}
+	if connection, err := goRvp.store.GetConnection(client.GetID(), subject); err == nil {
+		for _, scope := range strings.Split(connection.ScopeString, " ") {
+			granted[scope] = true
+		}
+	}
+
+	scopes := goRvp.consentScopes(client, ar.GetGrantedScopes(), granted)
+	if len(scopes) == 0 {
+		return true
+	}
+
+	decision := req.PostForm.Get("consent")
+	if req.Method != http.MethodPost || decision == "" {
+		goRvp.loginPages.render(rw, goRvp.loginPages.Consent, http.StatusOK, &ConsentPageData{
+			Action:     req.URL.Path,
+			CSRFToken:  csrfTokenOf(rw, req),
+			Params:     authorizeParams(ar.GetRequestForm()),
+			ClientID:   client.GetID(),
+			ClientName: client.GetName(),
+			Subject:    subject,
+			Scopes:     scopes,
+		})
+		return false
+	}
+	if !validCSRFToken(req) {
+		WriteRequestError(rw, req, ErrInvalidRequest)
+		return false
+	}
+	if decision != "allow" {
+		goRvp.oauth2.WriteAuthorizeError(rw, ar, pkgerrors.Wrap(fosite.ErrAccessDenied, "The user denied the request"))
+		return false
+	}
+
+	// drop the optional scopes the user deselected
+	if request, ok := ar.(*fosite.AuthorizeRequest); ok {
+		var grantedScopes fosite.Arguments
+		for name, chosen := range chosenScopes(req, scopes) {
+			granted[name] = chosen
+		}
+		for _, name := range request.GrantedScopes {
+			if granted[name] || name == ScopeOpenID {
+				grantedScopes = append(grantedScopes, name)
+			}
+		}
+		request.GrantedScopes = grantedScopes
+	}
+	return true
+}
+
+// authorizeParams returns the parameters of the authorize request without the
+// fields of the consent form, the request may have been posted.
+func authorizeParams(form url.Values) url.Values {
+	params := url.Values{}
+	for name, values := range form {
+		if name == csrfFormField || name == "consent" || name == "scope_choice" {
+			continue
+		}
+		params[name] = values
+	}
+	return params
+}
+
+// consentScopes returns the requested scopes the user is asked for, all but
+// the granted ones and openid.
+func (goRvp *GoRvp) consentScopes(client Client, requested []string, granted map[string]bool) []ConsentScope {
+	required := map[string]bool{}
+	for _, scope := range *client.GetFullScopes() {
+		required[scope.Name] = scope.Required
+	}
+	var scopes []ConsentScope
+	for _, name := range requested {
+		if granted[name] || name == ScopeOpenID {
+			continue
+		}
+		scopeInfo := &ScopeInfo{Name: name, DisplayName: name}
+		goRvp.store.DB.Where(&ScopeInfo{Name: name}).First(scopeInfo)
+		scopes = append(scopes, ConsentScope{
+			Name:        name,
+			DisplayName: scopeInfo.DisplayName,
+			Description: scopeInfo.Description,
+			Required:    required[name],
+		})
+	}
+	return scopes
+}
+
+// chosenScopes tells for each of scopes whether the user granted it, the
+// required ones are always granted.
+func chosenScopes(req *http.Request, scopes []ConsentScope) map[string]bool {
+	chosen := map[string]bool{}
+	for _, name := range req.PostForm["scope_choice"] {
+		chosen[name] = true
+	}
+	choice := map[string]bool{}
+	for _, scope := range scopes {
+		choice[scope.Name] = scope.Required || chosen[scope.Name]
+	}
+	return choice
+}
+
+// csrfTokenOf returns the csrf token of the browser, a new one is set if it
+// has none. The forms send it back and it has to match the cookie.
+func csrfTokenOf(rw http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	r := make([]byte, 16)
+	rand.Read(r)
+	token := hex.EncodeToString(r)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   GetForwardedInfo(req).Proto == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func validCSRFToken(req *http.Request) bool {
+	cookie, err := req.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.PostForm.Get(csrfFormField))) == 1
+}
+
+const defaultLoginTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="return_to" value="{{.ReturnTo}}">
+<p><label>Username <input type="text" name="username" value="{{.Username}}" autofocus required></label></p>
+<p><label>Password <input type="password" name="password" required></label></p>
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`
+
+const defaultConsentTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.ClientName}}</title></head>
+<body>
+<h1>{{.ClientName}} asks for access to your account</h1>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<ul>
+{{range .Scopes}}<li><label>
+<input type="checkbox" name="scope_choice" value="{{.Name}}" checked{{if .Required}} disabled{{end}}>
+<strong>{{.DisplayName}}</strong>{{if .Required}} (required){{end}}
+{{if .Description}}<br>{{.Description}}{{end}}
+</label></li>
+{{end}}</ul>
+<p>Signed in as {{.Subject}}</p>
+<p>
+<button type="submit" name="consent" value="allow">Allow</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</p>
+</form>
+</body>
+</html>
+`
@@ -0,0 +1,48 @@
+package gorvp
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConsentTemplateParams(t *testing.T) {
+	pages, err := NewLoginPages(LoginDocument{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a posted authorize request, sent again with the decision
+	form := url.Values{
+		"client_id":     {"app"},
+		"response_type": {"code"},
+		"scope":         {"profile email"},
+		"redirect_uri":  {"http://127.0.0.1:51004/callback?a=1&b=2"},
+		csrfFormField:   {"stale"},
+		"consent":       {"allow"},
+		"scope_choice":  {"email"},
+	}
+	params := authorizeParams(form)
+	if len(params) != 4 {
+		t.Errorf("expected the 4 authorize parameters, got %v", params)
+	}
+
+	body := &bytes.Buffer{}
+	err = pages.Consent.Execute(body, &ConsentPageData{Action: "/oauth/authorize", CSRFToken: "token", Params: params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{
+		`<input type="hidden" name="client_id" value="app">`,
+		`<input type="hidden" name="scope" value="profile email">`,
+		`<input type="hidden" name="redirect_uri" value="http://127.0.0.1:51004/callback?a=1&amp;b=2">`,
+		`<input type="hidden" name="csrf_token" value="token">`,
+	} {
+		if !strings.Contains(body.String(), field) {
+			t.Errorf("expected %s in the consent page", field)
+		}
+	}
+	if strings.Contains(body.String(), "stale") {
+		t.Error("the csrf token of the request is sent back")
+	}
+}
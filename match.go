@@ -6,7 +6,7 @@ import (
 	"strings"
 )
 
-func matchingHandlerOf(url, hostname string, handlers Handlers) (result http.Handler, found bool, scopes ConfigScopes) {
+func matchingHandlerOf(url, hostname string, handlers Handlers) (result http.Handler, found bool, matched *Handler) {
 
 	if handlers == nil {
 		return nil, false, nil
@@ -23,7 +23,7 @@ func matchingHandlerOf(url, hostname string, handlers Handlers) (result http.Han
 			debug("Matched %s%s with the handler attached to %s.", hostname, url, pattern)
 			found = true
 			result = http.StripPrefix(pattern, handler.server)
-			scopes = handler.scopes
+			matched = handler
 		}
 	}
 
@@ -31,23 +31,23 @@ func matchingHandlerOf(url, hostname string, handlers Handlers) (result http.Han
 		debug("Matched %s%s with default handler.", hostname, url)
 		found = true
 		result = handler.server
-		scopes = handler.scopes
+		matched = handler
 	}
 
-	return result, found, scopes
+	return result, found, matched
 }
 
-func matchingServerOf(host, url string) (result http.Handler, found bool, scopes ConfigScopes) {
+func (sites Sites) matchingServerOf(host, url string) (result http.Handler, found bool, matched *Handler) {
 
 	hostname := hostnameOf(host)
 	wildcard := wildcardOf(hostname)
 
-	result, found, scopes = matchingHandlerOf(url, hostname, sites[hostname])
+	result, found, matched = matchingHandlerOf(url, hostname, sites[hostname])
 
 	if !found {
 		if _, hasWildcard := sites[wildcard]; hasWildcard {
 			debug("Matching the wildcard %s", wildcard)
-			result, found, scopes = matchingHandlerOf(url, hostname, sites[wildcard])
+			result, found, matched = matchingHandlerOf(url, hostname, sites[wildcard])
 		} else {
 			debug("Nothing attached to %s or %s", hostname, wildcard)
 		}
@@ -55,14 +55,14 @@ func matchingServerOf(host, url string) (result http.Handler, found bool, scopes
 
 	if wildcardSite, hasWildcardSite := sites["*"]; !found && hasWildcardSite {
 		debug("No site binded to %s. Falling back to '*' entry.", hostname)
-		result, found, scopes = matchingHandlerOf(url, hostname, wildcardSite)
+		result, found, matched = matchingHandlerOf(url, hostname, wildcardSite)
 	} else if !found {
 		debug("Unable to find any matching site for %s", hostname)
 	} else {
 		debug("Returning matching site for %s%s.", hostname, url)
 	}
 
-	return result, found, scopes
+	return result, found, matched
 }
 
 func hostnameOf(host string) string {
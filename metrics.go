@@ -0,0 +1,190 @@
+package gorvp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/negroni"
+)
+
+const metricsStartKey = "gorvp:metrics_start"
+
+// Metrics holds the prometheus collectors of one gorvp instance,
+// all methods are no-op on a nil Metrics.
+type Metrics struct {
+	Registry                 *prometheus.Registry
+	Requests                 *prometheus.CounterVec
+	RequestDuration          *prometheus.HistogramVec
+	TokensIssued             *prometheus.CounterVec
+	AuthorizationFailures    *prometheus.CounterVec
+	IdentityProviderDuration *prometheus.HistogramVec
+	DatabaseQueryDuration    *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	requestLabels := []string{"site", "route", "backend", "status"}
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gorvp",
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests handled.",
+		}, requestLabels),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gorvp",
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, requestLabels),
+		TokensIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gorvp",
+			Name:      "oauth2_tokens_issued_total",
+			Help:      "Number of tokens issued by the token endpoint.",
+		}, []string{"grant_type"}),
+		AuthorizationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "gorvp",
+			Name:      "authorization_failures_total",
+			Help:      "Number of requests rejected with 401 or 403.",
+		}, []string{"type"}),
+		IdentityProviderDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gorvp",
+			Name:      "identity_provider_duration_seconds",
+			Help:      "Latency of the identity provider calls.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"provider", "result"}),
+		DatabaseQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "gorvp",
+			Name:      "database_query_duration_seconds",
+			Help:      "Latency of the database queries.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "table"}),
+	}
+	m.Registry.MustRegister(
+		m.Requests,
+		m.RequestDuration,
+		m.TokensIssued,
+		m.AuthorizationFailures,
+		m.IdentityProviderDuration,
+		m.DatabaseQueryDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// listenerMetrics is a negroni middleware recording every request of a listener.
+type listenerMetrics struct {
+	*Metrics
+	listener *Listener
+}
+
+// Middleware returns the middleware recording the requests of listener.
+func (m *Metrics) Middleware(listener *Listener) negroni.Handler {
+	return &listenerMetrics{Metrics: m, listener: listener}
+}
+
+// ServeHTTP records the request, the site, route and backend come from the
+// access log entry filled by JwtProxy. The Host header is not used as label,
+// any client could create new series with it.
+func (m *listenerMetrics) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	start := time.Now()
+	next(rw, r.WithContext(context.WithValue(r.Context(), metricsKey, m.Metrics)))
+
+	var site, route, backend string
+	if entry := GetAccessLogEntry(r); entry != nil {
+		site = entry.Site
+		route = entry.Route
+		backend = entry.Backend
+	}
+	if site == "" {
+		site = m.siteOf(r)
+	}
+	status := strconv.Itoa(rw.(negroni.ResponseWriter).Status())
+	m.Requests.WithLabelValues(site, route, backend, status).Inc()
+	m.RequestDuration.WithLabelValues(site, route, backend, status).Observe(time.Since(start).Seconds())
+}
+
+// siteOf labels the requests without a matching site with the listener, or
+// "unmatched" if the listener does not serve their host.
+func (m *listenerMetrics) siteOf(r *http.Request) string {
+	hosts := AllowedHosts(m.listener.Hosts)
+	if len(hosts) > 0 && !hosts.allowed(r.Host) {
+		return "unmatched"
+	}
+	return m.listener.Name
+}
+
+func (m *Metrics) TokenIssued(grantType string) {
+	if m == nil {
+		return
+	}
+	m.TokensIssued.WithLabelValues(grantType).Inc()
+}
+
+func (m *Metrics) AuthorizationFailure(goRvpErr *GoRvpError) {
+	if m == nil {
+		return
+	}
+	if goRvpErr.StatusCode == http.StatusUnauthorized || goRvpErr.StatusCode == http.StatusForbidden {
+		m.AuthorizationFailures.WithLabelValues(goRvpErr.Type).Inc()
+	}
+}
+
+func (m *Metrics) ObserveIdentityProvider(provider string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.IdentityProviderDuration.WithLabelValues(provider, result).Observe(time.Since(start).Seconds())
+}
+
+// InstrumentDB registers gorm callbacks timing every database operation.
+func (m *Metrics) InstrumentDB(db *gorm.DB) {
+	if m == nil {
+		return
+	}
+	before := func(scope *gorm.Scope) {
+		scope.Set(metricsStartKey, time.Now())
+	}
+	after := func(operation string) func(scope *gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			value, ok := scope.Get(metricsStartKey)
+			if !ok {
+				return
+			}
+			start := value.(time.Time)
+			m.DatabaseQueryDuration.WithLabelValues(operation, scope.TableName()).Observe(time.Since(start).Seconds())
+		}
+	}
+
+	callback := db.Callback()
+	callback.Create().Before("gorm:create").Register("metrics:before_create", before)
+	callback.Create().After("gorm:create").Register("metrics:after_create", after("create"))
+	callback.Query().Before("gorm:query").Register("metrics:before_query", before)
+	callback.Query().After("gorm:query").Register("metrics:after_query", after("query"))
+	callback.Update().Before("gorm:update").Register("metrics:before_update", before)
+	callback.Update().After("gorm:update").Register("metrics:after_update", after("update"))
+	callback.Delete().Before("gorm:delete").Register("metrics:before_delete", before)
+	callback.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete"))
+}
+
+func getMetrics(r *http.Request) *Metrics {
+	if r == nil {
+		return nil
+	}
+	m, _ := r.Context().Value(metricsKey).(*Metrics)
+	return m
+}
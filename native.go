@@ -0,0 +1,98 @@
+package gorvp
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ory-am/fosite"
+)
+
+// isLoopbackRedirectURI reports whether uri redirects to a port opened by the
+// app on the loopback interface (RFC 8252 section 7.3).
+func isLoopbackRedirectURI(uri *url.URL) bool {
+	if uri.Scheme != "http" {
+		return false
+	}
+	host := uri.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validNativeRedirectURI checks the redirect uri of a native app, either a
+// claimed https url, a private-use scheme in reverse domain notation or, if
+// allowLoopback, a loopback url.
+func validNativeRedirectURI(redirectURI string, allowLoopback bool) error {
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Fragment != "" {
+		return ErrInvalidRequest
+	}
+	switch {
+	case uri.Scheme == "https" && uri.Host != "":
+	case strings.Contains(uri.Scheme, "."):
+		// RFC 8252 section 7.1
+	case allowLoopback && isLoopbackRedirectURI(uri):
+	default:
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// validWebRedirectURI checks the redirect uri of a web client, an https url
+// or a loopback url for development.
+func validWebRedirectURI(redirectURI string) error {
+	uri, err := url.Parse(redirectURI)
+	if err != nil || uri.Fragment != "" || uri.Host == "" {
+		return ErrInvalidRequest
+	}
+	if uri.Scheme != "https" && !isLoopbackRedirectURI(uri) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// matchLoopbackRedirectURI lets apps use any port of a loopback redirect uri
+// registered without a port, the other redirect uris are matched exactly.
+// fosite matches the redirect uri exactly, so the registered uri is set in
+// form and the requested one is returned, nil if form has no such redirect uri.
+func (goRvp *GoRvp) matchLoopbackRedirectURI(clientID string, form url.Values) *url.URL {
+	requested, err := url.Parse(form.Get("redirect_uri"))
+	if err != nil || !isLoopbackRedirectURI(requested) || requested.Port() == "" {
+		return nil
+	}
+	client, err := goRvp.store.GetRvpClient(clientID)
+	if err != nil {
+		return nil
+	}
+	for _, redirectURI := range client.GetRedirectURIs() {
+		registered, err := url.Parse(redirectURI)
+		if err != nil || !isLoopbackRedirectURI(registered) || registered.Port() != "" {
+			continue
+		}
+		if registered.Hostname() == requested.Hostname() &&
+			registered.Path == requested.Path &&
+			registered.RawQuery == requested.RawQuery {
+			form.Set("redirect_uri", redirectURI)
+			return requested
+		}
+	}
+	return nil
+}
+
+// restoreRedirectURI sets the redirect uri with the port requested by the app
+// back in the authorize request. The form is kept with the authorization code,
+// so the token request has to send the same redirect uri, port included.
+func restoreRedirectURI(ar fosite.AuthorizeRequester, redirectURI *url.URL) {
+	if redirectURI == nil {
+		return
+	}
+	if request, ok := ar.(*fosite.AuthorizeRequest); ok {
+		request.RedirectURI = redirectURI
+	}
+	if form := ar.GetRequestForm(); form != nil {
+		form.Set("redirect_uri", redirectURI.String())
+	}
+}
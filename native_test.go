@@ -0,0 +1,126 @@
+package gorvp
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ory-am/fosite"
+)
+
+func TestValidNativeRedirectURI(t *testing.T) {
+	for _, c := range []struct {
+		redirectURI   string
+		allowLoopback bool
+		valid         bool
+	}{
+		{"com.example.app:/oauth", false, true},
+		{"com.example.app:/oauth", true, true},
+		{"https://app.example.com/oauth", false, true},
+		{"http://127.0.0.1/callback", true, true},
+		{"http://127.0.0.1:51004/callback", true, true},
+		{"http://[::1]/callback", true, true},
+		{"http://localhost", true, true},
+		{"http://127.0.0.1/callback", false, false},
+		{"http://localhost", false, false},
+		{"http://app.example.com/oauth", true, false},
+		{"https:/oauth", false, false},
+		{"myapp:/oauth", false, false},
+		{"com.example.app:/oauth#fragment", false, false},
+		{"https://app.example.com/oauth#fragment", false, false},
+		{"", true, false},
+		{"%", true, false},
+	} {
+		err := validNativeRedirectURI(c.redirectURI, c.allowLoopback)
+		if c.valid && err != nil {
+			t.Errorf("%q (loopback %t): unexpected error %s", c.redirectURI, c.allowLoopback, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%q (loopback %t): expected an error", c.redirectURI, c.allowLoopback)
+		}
+	}
+}
+
+func TestValidWebRedirectURI(t *testing.T) {
+	for _, c := range []struct {
+		redirectURI string
+		valid       bool
+	}{
+		{"https://app.example.com/oauth", true},
+		{"https://app.example.com:8443/oauth?tenant=1", true},
+		{"http://localhost:3000/oauth", true},
+		{"http://127.0.0.1/oauth", true},
+		{"http://app.example.com/oauth", false},
+		{"https://app.example.com/oauth#fragment", false},
+		{"com.example.app:/oauth", false},
+		{"/oauth", false},
+		{"", false},
+	} {
+		err := validWebRedirectURI(c.redirectURI)
+		if c.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", c.redirectURI, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%q: expected an error", c.redirectURI)
+		}
+	}
+}
+
+func TestMatchLoopbackRedirectURI(t *testing.T) {
+	goRvp := &GoRvp{store: newTestStore(t)}
+	createTestClient(t, goRvp.store, &GoRvpClient{ID: "native", AppType: AppTypeNative},
+		"http://127.0.0.1/callback", "http://[::1]/callback?app=1", "http://localhost:8080/callback", "com.example.app:/oauth")
+
+	for _, c := range []struct {
+		clientID   string
+		requested  string
+		registered string
+	}{
+		{"native", "http://127.0.0.1:51004/callback", "http://127.0.0.1/callback"},
+		{"native", "http://[::1]:51004/callback?app=1", "http://[::1]/callback?app=1"},
+		// matched exactly by fosite
+		{"native", "http://127.0.0.1/callback", ""},
+		{"native", "http://localhost:8080/callback", ""},
+		{"native", "com.example.app:/oauth", ""},
+		// the port is only free if the uri is registered without one
+		{"native", "http://localhost:8081/callback", ""},
+		{"native", "http://127.0.0.1:51004/other", ""},
+		{"native", "http://127.0.0.1:51004/callback?app=1", ""},
+		{"native", "http://[::1]:51004/callback", ""},
+		{"native", "http://localhost:51004/callback", ""},
+		{"native", "https://127.0.0.1:51004/callback", ""},
+		{"unknown", "http://127.0.0.1:51004/callback", ""},
+	} {
+		form := url.Values{"redirect_uri": {c.requested}}
+		requested := goRvp.matchLoopbackRedirectURI(c.clientID, form)
+		if c.registered == "" {
+			if requested != nil {
+				t.Errorf("%s %s: unexpected match", c.clientID, c.requested)
+			}
+			if form.Get("redirect_uri") != c.requested {
+				t.Errorf("%s %s: the redirect uri is replaced with %s", c.clientID, c.requested, form.Get("redirect_uri"))
+			}
+			continue
+		}
+		if requested == nil || requested.String() != c.requested {
+			t.Errorf("%s %s: the requested redirect uri is not returned", c.clientID, c.requested)
+		}
+		if form.Get("redirect_uri") != c.registered {
+			t.Errorf("%s %s: expected the registered %s, got %s", c.clientID, c.requested, c.registered, form.Get("redirect_uri"))
+		}
+	}
+}
+
+func TestRestoreRedirectURI(t *testing.T) {
+	form := url.Values{"redirect_uri": {"http://127.0.0.1/callback"}}
+	ar := &fosite.AuthorizeRequest{Request: fosite.Request{Form: form}}
+	requested, _ := url.Parse("http://127.0.0.1:51004/callback")
+
+	restoreRedirectURI(ar, requested)
+	if ar.RedirectURI.String() != requested.String() {
+		t.Errorf("expected the response to redirect to %s, got %s", requested, ar.RedirectURI)
+	}
+	// kept with the code, the token request has to send the same port
+	if form.Get("redirect_uri") != requested.String() {
+		t.Errorf("expected %s to be kept with the code, got %s", requested, form.Get("redirect_uri"))
+	}
+}
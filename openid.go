@@ -0,0 +1,118 @@
+package gorvp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
+)
+
+// ScopeOpenID asks for an id token in the authorize and token responses.
+const ScopeOpenID = "openid"
+
+const OpenIDConfigurationPath = "/.well-known/openid-configuration"
+
+// OpenIDConfiguration is the openid connect discovery document.
+type OpenIDConfiguration struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint,omitempty"`
+}
+
+func (goRvp *GoRvp) userInfoEndpoint(rw http.ResponseWriter, req *http.Request) {
+	claims, _, err := GetTokenClaimsFromBearer(goRvp.store, req)
+	if err != nil {
+		WriteRequestError(rw, req, err)
+		return
+	}
+	scopes := GetScopeArgumentFromClaims(claims)
+	if !scopes.Has(ScopeOpenID) {
+		WriteRequestError(rw, req, ErrClientPermission)
+		return
+	}
+	if entry := GetAccessLogEntry(req); entry != nil {
+		entry.Subject = claims.Subject
+		entry.ClientID = claims.Audience
+	}
+
+	if goRvp.store.OC == nil {
+		WriteRequestError(rw, req, ErrServerError)
+		return
+	}
+	userInfo, err := goRvp.store.OC.UserInfo(req.Context(), claims.Subject, scopes)
+	if err != nil {
+		WriteRequestError(rw, req, ErrServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(userInfo)
+}
+
+func (goRvp *GoRvp) openIDConfigurationEndpoint(rw http.ResponseWriter, req *http.Request) {
+	issuer := strings.TrimSuffix(goRvp.Config.Issuer, "/")
+	configuration := &OpenIDConfiguration{
+		Issuer:                            goRvp.Config.Issuer,
+		AuthorizationEndpoint:             issuer + goRvp.Config.Oauth2AuthMountPoint,
+		TokenEndpoint:                     issuer + goRvp.Config.Oauth2TokenMountPoint,
+		UserInfoEndpoint:                  issuer + goRvp.Config.UserInfoMountPoint,
+		IntrospectionEndpoint:             issuer + goRvp.Config.Oauth2IntrospectMountPoint,
+		RevocationEndpoint:                issuer + goRvp.Config.Oauth2RevokeMountPoint,
+		JWKSURI:                           issuer + JWKSPath,
+		ResponseTypesSupported:            []string{"code", "token", "id_token", "token id_token"},
+		GrantTypesSupported:               []string{"authorization_code", "implicit", "refresh_token", "password", "client_credentials", gorvpOauth2.GrantTypeJWTBearer},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  goRvp.signingAlgorithms(),
+		ScopesSupported:                   goRvp.scopesSupported(),
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"},
+		TokenEndpointAuthSigningAlgValuesSupported: []string{AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA},
+		ClaimsSupported:               []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash"},
+		CodeChallengeMethodsSupported: []string{codeChallengeMethodS256},
+	}
+
+	if goRvp.deviceFlowEnabled() {
+		configuration.DeviceAuthorizationEndpoint = issuer + goRvp.Config.Oauth2DeviceAuthorizationMountPoint
+		configuration.GrantTypesSupported = append(configuration.GrantTypesSupported, gorvpOauth2.GrantTypeDeviceCode)
+	}
+
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(rw).Encode(configuration)
+}
+
+func (goRvp *GoRvp) scopesSupported() []string {
+	scopes := []string{ScopeOpenID}
+	var scopeInfos []ScopeInfo
+	goRvp.store.DB.Find(&scopeInfos)
+	for _, scopeInfo := range scopeInfos {
+		scopes = append(scopes, scopeInfo.Name)
+	}
+	return scopes
+}
+
+// signingAlgorithms returns the algorithms of the keys validating the tokens.
+func (goRvp *GoRvp) signingAlgorithms() []string {
+	algorithms := []string{}
+	for _, key := range goRvp.keyring.ValidationKeys() {
+		algorithm := key.Algorithm()
+		if !stringIn(algorithm, algorithms) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms
+}
@@ -6,14 +6,20 @@ import (
 	"encoding/json"
 	"errors"
 	"bytes"
+	"io/ioutil"
 	"strconv"
+	"time"
 	goauth2 "golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v1"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type OwnerClient struct {
 	TokenEndpoint string
 	TrustedClient *TrustedClient
+	Metrics       *Metrics
+	// secret of the requests to the token endpoint, see RequestID
+	internalSecret string
 }
 
 type IdentityRequest struct {
@@ -21,6 +27,13 @@ type IdentityRequest struct {
 	Password string `json:"password"`
 }
 
+// UserInfoRequest asks the identity provider for the claims of a user,
+// scopes are the ones granted to the access token.
+type UserInfoRequest struct {
+	Subject string   `json:"sub"`
+	Scopes  []string `json:"scopes"`
+}
+
 func (oc *OwnerClient) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -32,7 +45,11 @@ func (oc *OwnerClient) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		Scopes:       oc.TrustedClient.Scopes.ToArguments(),
 		Endpoint:     goauth2.Endpoint{TokenURL: oc.TokenEndpoint},
 	}
-	token, err := conf.PasswordCredentialsToken(goauth2.NoContext,
+	// the token endpoint is called with the request id and the trace context of r
+	ctx := context.WithValue(r.Context(), goauth2.HTTPClient, &http.Client{
+		Transport: &internalTransport{ctx: r.Context(), secret: oc.internalSecret},
+	})
+	token, err := conf.PasswordCredentialsToken(ctx,
 		r.PostForm.Get("username"), r.PostForm.Get("password"))
 	if err != nil {
 		rw.WriteHeader(http.StatusNotFound)
@@ -43,30 +60,109 @@ func (oc *OwnerClient) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	rw.Write(tokenRes)
 }
 
-func (oc *OwnerClient) Authenticate(_ context.Context, username string, password string) error {
+func (oc *OwnerClient) Authenticate(ctx context.Context, username string, password string) (err error) {
+	if ctx == nil {
+		// callers without a request, the spans need a parent context
+		ctx = context.Background()
+	}
+	start := time.Now()
+	ctx, span := startSpan(ctx, "identity_provider.authenticate",
+		attribute.String("gorvp.identity_provider", oc.TrustedClient.Name))
+	defer func() {
+		endSpan(span, err)
+		oc.Metrics.ObserveIdentityProvider(oc.TrustedClient.Name, start, err)
+	}()
+	return oc.authenticate(ctx, username, password)
+}
+
+func (oc *OwnerClient) authenticate(ctx context.Context, username string, password string) error {
 	// request
 	ir := &IdentityRequest{
 		Username: username,
 		Password: password,
 	}
-	requestJson, _ := json.Marshal(ir)
+	resp, err := oc.post(ctx, oc.TrustedClient.IdentityEndpoint, ir)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return errors.New("User not found or wrong password")
+}
+
+// UserInfo returns the claims of the user from the identity provider, only
+// the subject is returned if the provider has no userinfo endpoint.
+func (oc *OwnerClient) UserInfo(ctx context.Context, subject string, scopes []string) (claims map[string]interface{}, err error) {
+	if oc.TrustedClient.UserInfoEndpoint == "" {
+		return map[string]interface{}{"sub": subject}, nil
+	}
+
+	start := time.Now()
+	ctx, span := startSpan(ctx, "identity_provider.userinfo",
+		attribute.String("gorvp.identity_provider", oc.TrustedClient.Name))
+	defer func() {
+		endSpan(span, err)
+		oc.Metrics.ObserveIdentityProvider(oc.TrustedClient.Name, start, err)
+	}()
+
+	resp, err := oc.post(ctx, oc.TrustedClient.UserInfoEndpoint, &UserInfoRequest{
+		Subject: subject,
+		Scopes:  scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("User not found")
+	}
+
+	// the response is encrypted with the shared key as well
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := jose.ParseEncrypted(string(body))
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := encrypted.Decrypt([]byte(oc.TrustedClient.SharedKey))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(decrypted, &claims)
+	if err != nil {
+		return nil, err
+	}
+	claims["sub"] = subject
+	return claims, nil
+}
+
+// post sends v encrypted with the shared key to the identity provider.
+func (oc *OwnerClient) post(ctx context.Context, endpoint string, v interface{}) (*http.Response, error) {
+	requestJson, _ := json.Marshal(v)
 
 	encrypter, err := jose.NewEncrypter(jose.DIRECT, jose.A256GCM, []byte(oc.TrustedClient.SharedKey))
+	if err != nil {
+		return nil, err
+	}
 	encryptedRequest, err := encrypter.Encrypt(requestJson)
+	if err != nil {
+		return nil, err
+	}
 	serializedRequest := encryptedRequest.FullSerialize()
 
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", oc.TrustedClient.IdentityEndpoint, bytes.NewBufferString(serializedRequest))
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(serializedRequest))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	setCorrelationHeaders(ctx, req.Header)
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Content-Length", strconv.Itoa(len([]byte(serializedRequest))))
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode == http.StatusOK {
-		return nil
-	}
-	return errors.New("User not found or wrong password")
+	return client.Do(req)
 }
-
@@ -0,0 +1,76 @@
+package gorvp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+
+	"github.com/ory-am/fosite"
+	"github.com/ory-am/fosite/token/jwt"
+	"github.com/pkg/errors"
+)
+
+// the only code challenge method supported, plain would expose the verifier
+const codeChallengeMethodS256 = "S256"
+
+// claim of the authorization code holding the code challenge
+const codeChallengeClaim = "cch"
+
+// code verifiers are 43 to 128 unreserved characters (RFC 7636 section 4.1),
+// an S256 challenge is always 43 characters long
+var (
+	codeVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+)
+
+// requirePKCE reports whether the authorization code requests of client need
+// a code challenge, always for native apps (RFC 8252 section 8.1).
+func (goRvp *GoRvp) requirePKCE(client Client) bool {
+	return client.IsPKCERequired() || client.GetAppType() == AppTypeNative ||
+		(goRvp.Config.RequirePKCE && client.IsPublic())
+}
+
+// setCodeChallenge validates the code challenge of the authorize request and
+// keeps it in the authorization code, which is signed so the challenge can not
+// be changed before the code is exchanged.
+func (goRvp *GoRvp) setCodeChallenge(ar fosite.AuthorizeRequester, session *Session) error {
+	if !ar.GetResponseTypes().Has("code") {
+		return nil
+	}
+	challenge := ar.GetRequestForm().Get("code_challenge")
+	method := ar.GetRequestForm().Get("code_challenge_method")
+	if challenge == "" {
+		if goRvp.requirePKCE(ar.GetClient().(Client)) {
+			return errors.Wrap(fosite.ErrInvalidRequest, "The client must send a code challenge")
+		}
+		return nil
+	}
+	if method != codeChallengeMethodS256 {
+		return errors.Wrap(fosite.ErrInvalidRequest, "The code challenge method must be S256")
+	}
+	if !codeChallengePattern.MatchString(challenge) {
+		return errors.Wrap(fosite.ErrInvalidRequest, "The code challenge is malformed")
+	}
+	session.JWTClaims.Add(codeChallengeClaim, challenge)
+	return nil
+}
+
+// verifyCodeVerifier checks the code verifier of the token request against the
+// challenge in the claims of the authorization code.
+func verifyCodeVerifier(claims *jwt.JWTClaims, verifier string) error {
+	challenge, _ := claims.Get(codeChallengeClaim).(string)
+	if challenge == "" {
+		if verifier != "" {
+			return errors.Wrap(fosite.ErrInvalidGrant, "The authorization code was issued without a code challenge")
+		}
+		return nil
+	}
+	if !codeVerifierPattern.MatchString(verifier) {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The code verifier is missing or malformed")
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		return errors.Wrap(fosite.ErrInvalidGrant, "The code verifier does not match the code challenge")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package gorvp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ory-am/fosite"
+	"github.com/ory-am/fosite/token/jwt"
+)
+
+// the example of RFC 7636 appendix B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mJ92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestVerifyCodeVerifier(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		challenge string
+		verifier  string
+		valid     bool
+	}{
+		{"matching verifier", testCodeChallenge, testCodeVerifier, true},
+		{"no challenge and no verifier", "", "", true},
+		{"verifier without challenge", "", testCodeVerifier, false},
+		{"missing verifier", testCodeChallenge, "", false},
+		{"other verifier", testCodeChallenge, strings.Repeat("a", 43), false},
+		{"short verifier", testCodeChallenge, testCodeVerifier[:42], false},
+		{"long verifier", testCodeChallenge, strings.Repeat("a", 129), false},
+		{"reserved characters", testCodeChallenge, testCodeVerifier[:42] + "+", false},
+		{"challenge as verifier", testCodeChallenge, testCodeChallenge, false},
+	} {
+		claims := &jwt.JWTClaims{}
+		if c.challenge != "" {
+			claims.Add(codeChallengeClaim, c.challenge)
+		}
+		err := verifyCodeVerifier(claims, c.verifier)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestSetCodeChallenge(t *testing.T) {
+	for _, c := range []struct {
+		name          string
+		client        *GoRvpClient
+		requirePKCE   bool
+		responseTypes fosite.Arguments
+		challenge     string
+		method        string
+		valid         bool
+		kept          bool
+	}{
+		{"S256 challenge", &GoRvpClient{AppType: AppTypeAndroid}, false, fosite.Arguments{"code"}, testCodeChallenge, "S256", true, true},
+		{"no challenge", &GoRvpClient{AppType: AppTypeWebBackend}, false, fosite.Arguments{"code"}, "", "", true, false},
+		{"implicit grant", &GoRvpClient{AppType: AppTypeNative}, false, fosite.Arguments{"token"}, "", "", true, false},
+		{"plain method", &GoRvpClient{AppType: AppTypeAndroid}, false, fosite.Arguments{"code"}, testCodeChallenge, "plain", false, false},
+		{"missing method", &GoRvpClient{AppType: AppTypeAndroid}, false, fosite.Arguments{"code"}, testCodeChallenge, "", false, false},
+		{"malformed challenge", &GoRvpClient{AppType: AppTypeAndroid}, false, fosite.Arguments{"code"}, testCodeChallenge[:42], "S256", false, false},
+		{"native app without challenge", &GoRvpClient{AppType: AppTypeNative}, false, fosite.Arguments{"code"}, "", "", false, false},
+		{"client requiring pkce", &GoRvpClient{AppType: AppTypeWebBackend, RequirePKCE: true}, false, fosite.Arguments{"code"}, "", "", false, false},
+		{"public client with require_pkce", &GoRvpClient{AppType: AppTypeWebApp, Public: true}, true, fosite.Arguments{"code"}, "", "", false, false},
+		{"confidential client with require_pkce", &GoRvpClient{AppType: AppTypeWebBackend}, true, fosite.Arguments{"code"}, "", "", true, false},
+	} {
+		goRvp := &GoRvp{Config: &Config{RequirePKCE: c.requirePKCE}}
+		form := url.Values{}
+		if c.challenge != "" {
+			form.Set("code_challenge", c.challenge)
+		}
+		if c.method != "" {
+			form.Set("code_challenge_method", c.method)
+		}
+		ar := &fosite.AuthorizeRequest{
+			ResponseTypes: c.responseTypes,
+			Request: fosite.Request{
+				Client: c.client,
+				Form:   form,
+			},
+		}
+		session := NewSession(goRvp.Config, "user", fosite.Arguments{}, c.client.ID, &Connection{})
+
+		err := goRvp.setCodeChallenge(ar, session)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+		challenge, _ := session.JWTClaims.Get(codeChallengeClaim).(string)
+		if c.kept && challenge != c.challenge {
+			t.Errorf("%s: the challenge is not kept in the session", c.name)
+		}
+		if !c.kept && challenge != "" {
+			t.Errorf("%s: unexpected challenge %s in the session", c.name, challenge)
+		}
+	}
+}
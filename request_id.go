@@ -0,0 +1,111 @@
+package gorvp
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/pilu/xrequestid"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+const maxRequestIDLength = 128
+
+// internalHopHeader carries the secret of the requests gorvp sends to itself,
+// their request id is kept even if the peer is not a trusted proxy.
+const internalHopHeader = "X-Gorvp-Internal"
+
+// RequestID is a negroni middleware giving every request one correlation id.
+// The id sent by a trusted proxy or by gorvp itself is kept, otherwise a new
+// one is generated.
+// It is set on the request header so it is forwarded to the backends, on the
+// response header, and in the request context.
+type RequestID struct {
+	generator *xrequestid.XRequestID
+	// the secret of internalHopHeader, none is accepted if empty
+	internalSecret string
+}
+
+func NewRequestID(size int) *RequestID {
+	return &RequestID{generator: xrequestid.New(size)}
+}
+
+func (m *RequestID) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(RequestIDHeader)
+	internal := m.internalHop(r)
+	if !(GetForwardedInfo(r).TrustedPeer || internal) || !isValidRequestID(id) {
+		var err error
+		id, err = m.generator.Generate(m.generator.Size)
+		if err != nil {
+			id = ""
+		}
+	}
+	if id == "" {
+		r.Header.Del(RequestIDHeader)
+		next(rw, r)
+		return
+	}
+	r.Header.Set(RequestIDHeader, id)
+	rw.Header().Set(RequestIDHeader, id)
+	next(rw, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+}
+
+// internalHop reports whether gorvp sent r to itself, the secret is removed so
+// it is not forwarded.
+func (m *RequestID) internalHop(r *http.Request) bool {
+	secret := r.Header.Get(internalHopHeader)
+	r.Header.Del(internalHopHeader)
+	return m.internalSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(m.internalSecret)) == 1
+}
+
+// internalTransport sends the requests gorvp makes to itself with the request
+// id and the trace context of ctx, so they are correlated with the request of
+// the client.
+type internalTransport struct {
+	ctx    context.Context
+	secret string
+}
+
+func (t *internalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(t.ctx)
+	setCorrelationHeaders(t.ctx, req.Header)
+	req.Header.Set(internalHopHeader, t.secret)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// setCorrelationHeaders sets the trace context and the request id of ctx on
+// the header of an outgoing request.
+func setCorrelationHeaders(ctx context.Context, header http.Header) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(header))
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		header.Set(RequestIDHeader, requestID)
+	}
+}
+
+// RequestIDFromContext returns the correlation id of the request, empty if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func GetRequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return RequestIDFromContext(r.Context())
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -10,9 +10,13 @@ import (
 )
 
 func ReverseProxyServer(uri string) http.Handler {
+	return reverseProxyServer(uri, false)
+}
+
+func reverseProxyServer(uri string, rewriteHost bool) http.Handler {
 	debug("Returning a reverse proxy server for %s.", uri)
 	dest, _ := url.Parse(addProtocol(uri))
-	return NewSingleHostReverseProxy(dest)
+	return newSingleHostReverseProxy(dest, rewriteHost)
 }
 
 func newStaticServer(uri string, hasCustom404 bool, custom404 string) http.Handler {
@@ -48,9 +52,21 @@ func singleJoiningSlashWithoutTrailing(a, b string) string {
 	return a + b
 }
 
+// NewSingleHostReverseProxy returns a reverse proxy to target, which sends the
+// Host header of the client to the backend.
 func NewSingleHostReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return newSingleHostReverseProxy(target, false)
+}
+
+// newSingleHostReverseProxy sends the host of target to the backend instead
+// if rewriteHost is set.
+func newSingleHostReverseProxy(target *url.URL, rewriteHost bool) *httputil.ReverseProxy {
 	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
+		setForwardedHeaders(req, GetForwardedInfo(req))
+		if rewriteHost {
+			req.Host = target.Host
+		}
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path = singleJoiningSlashWithoutTrailing(target.Path, req.URL.Path)
@@ -60,5 +76,19 @@ func NewSingleHostReverseProxy(target *url.URL) *httputil.ReverseProxy {
 			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 		}
 	}
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{
+		Director:     director,
+		Transport:    newTracingTransport(),
+		ErrorHandler: proxyErrorHandler,
+	}
+}
+
+func proxyErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	if IsBodyTooLarge(err) {
+		// streamed body exceeded the limit after the request was forwarded
+		WriteRequestError(rw, req, ErrRequestEntityTooLarge)
+		return
+	}
+	debug("http: proxy error: %v", err)
+	rw.WriteHeader(http.StatusBadGateway)
 }
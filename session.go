@@ -10,6 +10,10 @@ import (
 
 type Session struct {
 	ScopeSeparator string
+	// see Token.GrantID
+	GrantID        string
+	IDClaims       *jwt.IDTokenClaims `json:"id_token_claims"`
+	IDHeaders      *jwt.Headers       `json:"id_token_headers"`
 	*core.JWTSession
 }
 
@@ -34,12 +38,31 @@ func NewSession(config *Config, userID string, scopes fosite.Arguments, clientID
 			Username: userID,
 		},
 		ScopeSeparator: " ",
+		IDClaims: &jwt.IDTokenClaims{
+			Issuer:   config.Issuer,
+			Subject:  userID,
+			Audience: clientID,
+			IssuedAt: time.Now(),
+			Extra:    make(map[string]interface{}),
+		},
+		IDHeaders: &jwt.Headers{
+			Extra: make(map[string]interface{}),
+		},
 	}
 	session.SetScopes(scopes)
 	session.SetConnection(connection)
 	return session
 }
 
+// IDTokenClaims is used by the openid connect handlers to issue the id token.
+func (s *Session) IDTokenClaims() *jwt.IDTokenClaims {
+	return s.IDClaims
+}
+
+func (s *Session) IDTokenHeaders() *jwt.Headers {
+	return s.IDHeaders
+}
+
 func (s *Session) CopyScopeFromClaims(claims *jwt.JWTClaims) {
 	s.JWTClaims.Add("sco", claims.Get("sco"))
 }
@@ -57,7 +80,8 @@ func GrantScope(oauth2 fosite.OAuth2Provider, ar fosite.Requester) error {
 	clientScopes := requestClient.GetScopes()
 
 	for _, requestScope := range ar.GetRequestedScopes() {
-		if clientScopes.Has(requestScope) {
+		// openid is not a scope of the clients, it only asks for an id token
+		if requestScope == ScopeOpenID || clientScopes.Has(requestScope) {
 			ar.GrantScope(requestScope)
 		} else {
 			return ErrClientPermission
@@ -2,15 +2,16 @@ package gorvp
 
 type Sites map[string]Handlers
 
-var sites Sites
-
-func SetupSites(config *Config) {
-	newSites := make(Sites)
+func NewSites(config *Config) Sites {
+	sites := make(Sites)
 
 	for hostname, frontend := range config.Frontend {
 		debug("Setting up %s", hostname)
-		newSites[hostname] = handlersOf(frontend)
+		sites[hostname] = handlersOf(frontend)
+		for _, handler := range sites[hostname] {
+			handler.site = hostname
+		}
 	}
 
-	sites = newSites
+	return sites
 }
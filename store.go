@@ -9,11 +9,19 @@ import (
 	"github.com/pilu/xrequestid"
 	"github.com/pborman/uuid"
 	"fmt"
+	"log"
+	"time"
+	"crypto/sha256"
+	"encoding/hex"
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
 )
 
 type Store struct {
-	DB *gorm.DB
-	OC *OwnerClient
+	DB            *gorm.DB
+	OC            *OwnerClient
+	TokenStrategy *GoRvpStrategy
+	// the aud the clients sign their assertions for, the token endpoint or the issuer
+	AssertionAudiences []string
 }
 
 func (store *Store) Migrate() {
@@ -23,6 +31,38 @@ func (store *Store) Migrate() {
 	store.DB.AutoMigrate(&ScopeInfo{})
 	store.DB.AutoMigrate(&ClientRevocation{})
 	store.DB.AutoMigrate(&Connection{})
+	store.DB.AutoMigrate(&OpenIDConnectSession{})
+	store.DB.AutoMigrate(&KeyringVersion{})
+	store.DB.AutoMigrate(&SigningKeyRecord{})
+	store.DB.AutoMigrate(&DeviceCode{})
+	store.DB.AutoMigrate(&UsedAssertion{})
+	store.migrateAndroidRedirectURIs()
+}
+
+// androidLegacyRedirectURI is where the android clients registered without a
+// redirect uri were redirected to.
+const androidLegacyRedirectURI = "http://localhost"
+
+// migrateAndroidRedirectURIs registers the legacy redirect uri of the android
+// clients without one, which can be replaced on the admin api then.
+func (store *Store) migrateAndroidRedirectURIs() {
+	clients := []GoRvpClient{}
+	err := store.DB.Where("app_type = ?", AppTypeAndroid).Find(&clients).Error
+	if err != nil {
+		log.Printf("can not migrate the redirect uris of the android clients: %s", err)
+		return
+	}
+	for i := range clients {
+		client := &clients[i]
+		client.UnmarshalRedirectURIsJSON()
+		if len(client.RedirectURIs) > 0 {
+			continue
+		}
+		client.SetRedirectURIs([]string{androidLegacyRedirectURI})
+		if err := store.UpdateRedirectURIs(client); err != nil {
+			log.Printf("can not migrate the redirect uri of the android client %s: %s", client.ID, err)
+		}
+	}
 }
 
 func (store *Store) GetClient(id string) (fosite.Client, error) {
@@ -36,6 +76,9 @@ func (store *Store) GetRvpClient(id string) (*GoRvpClient, error) {
 		return nil, fosite.ErrNotFound
 	}
 	client.UnmarshalScopesJSON()
+	client.UnmarshalIPRulesJSON()
+	client.UnmarshalRedirectURIsJSON()
+	client.UnmarshalJWKSJSON()
 	return client, nil
 }
 
@@ -48,6 +91,9 @@ func (store *Store) GetRvpClients() ([]GoRvpClient, error) {
 
 	for i, _ := range clients {
 		clients[i].UnmarshalScopesJSON()
+		clients[i].UnmarshalIPRulesJSON()
+		clients[i].UnmarshalRedirectURIsJSON()
+		clients[i].UnmarshalJWKSJSON()
 	}
 	return clients, nil
 }
@@ -108,8 +154,15 @@ func (store *Store) DeleteAuthorizeCodeSession(_ context.Context, signature stri
 }
 
 func (store *Store) CreateTokenSession(_ context.Context, signature string, req fosite.Requester, refreshToken bool) (err error) {
-	dataJSON, _ := json.Marshal(req)
 	session := req.GetSession()
+	grantID := ""
+	if s, ok := session.(*Session); ok {
+		if s.GrantID == "" {
+			s.GrantID = uuid.New()
+		}
+		grantID = s.GrantID
+	}
+	dataJSON, _ := json.Marshal(req)
 
 	token := &Token{
 		Signature: signature,
@@ -117,6 +170,7 @@ func (store *Store) CreateTokenSession(_ context.Context, signature string, req
 		ClientID: req.GetClient().GetID(),
 		UserID: session.GetUsername(),
 		RefreshToken: refreshToken,
+		GrantID: grantID,
 	}
 	err = store.DB.Create(token).Error
 
@@ -206,6 +260,12 @@ func (store *Store) PersistAuthorizeCodeGrantSession(ctx context.Context, author
 }
 
 func (store *Store) PersistRefreshTokenGrantSession(ctx context.Context, originalRefreshSignature, accessSignature, refreshSignature string, request fosite.Requester) error {
+	// the refreshed tokens stay in the grant of the original refresh token
+	if original, err := store.GetToken(originalRefreshSignature); err == nil {
+		if s, ok := request.GetSession().(*Session); ok && original.GrantID != "" {
+			s.GrantID = original.GrantID
+		}
+	}
 	if err := store.DeleteRefreshTokenSession(ctx, originalRefreshSignature); err != nil {
 		return err
 	} else if err := store.CreateAccessTokenSession(ctx, accessSignature, request); err != nil {
@@ -216,6 +276,55 @@ func (store *Store) PersistRefreshTokenGrantSession(ctx context.Context, origina
 	return nil
 }
 
+func (store *Store) CreateOpenIDConnectSession(_ context.Context, authorizeCode string, requester fosite.Requester) error {
+	dataJSON, _ := json.Marshal(requester)
+	session := &OpenIDConnectSession{
+		Signature: authorizeCode,
+		DataJSON: string(dataJSON),
+	}
+	err := store.DB.Create(session).Error
+	if err != nil {
+		return fosite.ErrServerError
+	}
+	return nil
+}
+
+func (store *Store) GetOpenIDConnectSession(_ context.Context, authorizeCode string, _ fosite.Requester) (fosite.Requester, error) {
+	session := &OpenIDConnectSession{Signature: authorizeCode}
+	err := store.DB.Find(session).Error
+	if err != nil {
+		return nil, fosite.ErrNotFound
+	}
+	req := &fosite.Request{
+		Client: &GoRvpClient{},
+		Session: &Session{},
+	}
+	json.Unmarshal([]byte(session.DataJSON), &req)
+	return req, nil
+}
+
+func (store *Store) DeleteOpenIDConnectSession(_ context.Context, authorizeCode string) error {
+	err := store.DB.Delete(&OpenIDConnectSession{Signature: authorizeCode}).Error
+	if err != nil {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+// RevokeToken deletes token, revoking a refresh token also deletes the tokens of its grant.
+func (store *Store) RevokeToken(token *Token) error {
+	var err error
+	if token.RefreshToken && token.GrantID != "" {
+		err = store.DB.Where("grant_id = ? AND client_id = ?", token.GrantID, token.ClientID).Delete(&Token{}).Error
+	} else {
+		err = store.DB.Delete(token).Error
+	}
+	if err != nil {
+		return ErrDatabase
+	}
+	return nil
+}
+
 func (store *Store) CreateTrustedClient(trustedClient *TrustedClient) {
 	// create one if not exist, or override the first created one
 	client := &GoRvpClient{Name: trustedClient.Name}
@@ -328,6 +437,157 @@ func (store *Store) UpdateConnection(clientID string, userID string, scopes []st
 	return connection, nil
 }
 
+// deviceCodeSignature is the key of a device code in the store.
+func deviceCodeSignature(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *Store) CreateDeviceCode(deviceCode string, record *DeviceCode) error {
+	// the expired ones are not needed anymore
+	store.DB.Where("expires_at < ?", time.Now()).Delete(&DeviceCode{})
+
+	record.Signature = deviceCodeSignature(deviceCode)
+	record.State = DeviceCodePending
+	if err := store.DB.Create(record).Error; err != nil {
+		return ErrDatabase
+	}
+	return nil
+}
+
+// GetPendingDeviceCode returns the unexpired device code of userCode the user
+// did not decide on yet.
+func (store *Store) GetPendingDeviceCode(userCode string) (*DeviceCode, error) {
+	record := &DeviceCode{}
+	err := store.DB.Where("user_code = ? AND state = ?", userCode, DeviceCodePending).First(record).Error
+	if err != nil || time.Now().After(record.ExpiresAt) {
+		return nil, ErrRecordNotFound
+	}
+	return record, nil
+}
+
+// DecideDeviceCode saves the decision of the user, req is the request the
+// tokens are issued for if the user approved.
+func (store *Store) DecideDeviceCode(record *DeviceCode, userID string, req fosite.Requester) error {
+	decision := map[string]interface{}{"user_id": userID, "state": DeviceCodeDenied}
+	if req != nil {
+		dataJSON, _ := json.Marshal(req)
+		decision["data_json"] = string(dataJSON)
+		decision["state"] = DeviceCodeApproved
+	}
+	// a device code is decided once
+	result := store.DB.Model(&DeviceCode{}).
+		Where("signature = ? AND state = ?", record.Signature, DeviceCodePending).
+		Updates(decision)
+	if result.Error != nil {
+		return ErrDatabase
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// GetDeviceCodeSession is polled by the device at the token endpoint, the
+// interval is increased by 5 seconds if it polls too often (RFC 8628 section 3.5).
+func (store *Store) GetDeviceCodeSession(_ context.Context, deviceCode string, _ fosite.Session) (fosite.Requester, error) {
+	record := &DeviceCode{Signature: deviceCodeSignature(deviceCode)}
+	if err := store.DB.Find(record).Error; err != nil {
+		return nil, fosite.ErrInvalidGrant
+	}
+	now := time.Now()
+	if now.After(record.ExpiresAt) {
+		return nil, gorvpOauth2.ErrExpiredToken
+	}
+	// only the polling columns are saved, the state may be changed concurrently
+	polled := map[string]interface{}{"last_polled_at": now}
+	if record.LastPolledAt != nil && now.Sub(*record.LastPolledAt) < time.Duration(record.Interval) * time.Second {
+		polled["interval"] = record.Interval + 5
+		store.DB.Model(record).Updates(polled)
+		return nil, gorvpOauth2.ErrSlowDown
+	}
+	store.DB.Model(record).Updates(polled)
+
+	switch record.State {
+	case DeviceCodePending:
+		return nil, gorvpOauth2.ErrAuthorizationPending
+	case DeviceCodeDenied:
+		return nil, gorvpOauth2.ErrDeviceAccessDenied
+	case DeviceCodeRedeemed:
+		return nil, fosite.ErrInvalidGrant
+	}
+	req := &fosite.Request{
+		Client: &GoRvpClient{},
+		Session: &Session{},
+	}
+	json.Unmarshal([]byte(record.DataJSON), &req)
+	return req, nil
+}
+
+// RedeemDeviceCode claims the approved device code for one token request,
+// the concurrent polls of the same code fail.
+func (store *Store) RedeemDeviceCode(_ context.Context, deviceCode string) error {
+	result := store.DB.Model(&DeviceCode{}).
+		Where("signature = ? AND state = ?", deviceCodeSignature(deviceCode), DeviceCodeApproved).
+		Update("state", DeviceCodeRedeemed)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return fosite.ErrInvalidGrant
+	}
+	return nil
+}
+
+func (store *Store) InvalidateDeviceCodeSession(_ context.Context, deviceCode string) error {
+	record := &DeviceCode{Signature: deviceCodeSignature(deviceCode)}
+	if err := store.DB.Delete(record).Error; err != nil {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+// UpdateJWKS saves the public keys of client.
+func (store *Store) UpdateJWKS(client *GoRvpClient) error {
+	err := store.DB.Model(client).Updates(map[string]interface{}{
+		"jwks_json": client.JWKSJSON,
+	}).Error
+	if err != nil {
+		return ErrDatabase
+	}
+	return nil
+}
+
+// VerifyAssertion verifies a jwt assertion of the client with its public keys,
+// the jti is kept until the assertion expires so it is accepted once.
+func (store *Store) VerifyAssertion(_ context.Context, clientID string, assertion string) error {
+	client, err := store.GetRvpClient(clientID)
+	if err != nil {
+		return ErrInvalidClient
+	}
+	jti, expiresAt, err := verifyAssertion(client, assertion, store.AssertionAudiences)
+	if err != nil {
+		return err
+	}
+	// the expired ones are not needed anymore
+	store.DB.Where("expires_at < ?", time.Now()).Delete(&UsedAssertion{})
+	// the primary key rejects a jti used before
+	err = store.DB.Create(&UsedAssertion{ClientID: clientID, JTI: jti, ExpiresAt: expiresAt}).Error
+	if err != nil {
+		return fmt.Errorf("the assertion %s was used before", jti)
+	}
+	return nil
+}
+
+// UpdateRedirectURIs saves the redirect uris of client.
+func (store *Store) UpdateRedirectURIs(client *GoRvpClient) error {
+	err := store.DB.Model(client).Updates(map[string]interface{}{
+		"redirect_uri":       client.RedirectURI,
+		"redirect_uris_json": client.RedirectURIsJSON,
+	}).Error
+	if err != nil {
+		return ErrDatabase
+	}
+	return nil
+}
+
 func (store *Store) ResetClientPassword(clientID string) (string, error) {
 	client, err := store.GetRvpClient(clientID)
 	if err != nil {
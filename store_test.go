@@ -0,0 +1,143 @@
+package gorvp
+
+import (
+	"testing"
+	"time"
+
+	gorvpOauth2 "github.com/jacyzon/gorvp/handler/oauth2"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/ory-am/fosite"
+	"golang.org/x/net/context"
+)
+
+// newTestStore returns a store on a migrated in-memory database.
+func newTestStore(t *testing.T) *Store {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would open another in-memory database
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	store := &Store{DB: db}
+	store.Migrate()
+	return store
+}
+
+// createTestClient saves client with its redirect uris.
+func createTestClient(t *testing.T, store *Store, client *GoRvpClient, redirectURIs ...string) {
+	client.SetRedirectURIs(redirectURIs)
+	if err := store.DB.Create(client).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestDeviceCode saves a pending device code polled every interval seconds.
+func createTestDeviceCode(t *testing.T, store *Store, deviceCode string, interval int, expiresIn time.Duration) *DeviceCode {
+	record := &DeviceCode{
+		UserCode:  deviceCode + "-user",
+		ClientID:  "tv",
+		Interval:  interval,
+		ExpiresAt: time.Now().Add(expiresIn),
+	}
+	if err := store.CreateDeviceCode(deviceCode, record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestGetDeviceCodeSessionPending(t *testing.T) {
+	store := newTestStore(t)
+	createTestDeviceCode(t, store, "pending", 5, time.Minute)
+
+	if _, err := store.GetDeviceCodeSession(context.Background(), "pending", nil); err != gorvpOauth2.ErrAuthorizationPending {
+		t.Errorf("expected authorization_pending, got %v", err)
+	}
+}
+
+func TestGetDeviceCodeSessionSlowDown(t *testing.T) {
+	store := newTestStore(t)
+	createTestDeviceCode(t, store, "polling", 5, time.Minute)
+
+	store.GetDeviceCodeSession(context.Background(), "polling", nil)
+	if _, err := store.GetDeviceCodeSession(context.Background(), "polling", nil); err != gorvpOauth2.ErrSlowDown {
+		t.Fatalf("expected slow_down, got %v", err)
+	}
+	record := &DeviceCode{Signature: deviceCodeSignature("polling")}
+	if err := store.DB.Find(record).Error; err != nil {
+		t.Fatal(err)
+	}
+	if record.Interval != 10 {
+		t.Errorf("expected the interval to be increased to 10, got %d", record.Interval)
+	}
+	if record.State != DeviceCodePending {
+		t.Errorf("the state changed to %s", record.State)
+	}
+}
+
+func TestGetDeviceCodeSessionExpired(t *testing.T) {
+	store := newTestStore(t)
+	createTestDeviceCode(t, store, "expired", 5, -time.Second)
+
+	if _, err := store.GetDeviceCodeSession(context.Background(), "expired", nil); err != gorvpOauth2.ErrExpiredToken {
+		t.Errorf("expected expired_token, got %v", err)
+	}
+}
+
+func TestGetDeviceCodeSessionUnknown(t *testing.T) {
+	store := newTestStore(t)
+
+	if _, err := store.GetDeviceCodeSession(context.Background(), "unknown", nil); err != fosite.ErrInvalidGrant {
+		t.Errorf("expected invalid_grant, got %v", err)
+	}
+}
+
+func TestGetDeviceCodeSessionDenied(t *testing.T) {
+	store := newTestStore(t)
+	record := createTestDeviceCode(t, store, "denied", 0, time.Minute)
+	if err := store.DecideDeviceCode(record, "user", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetDeviceCodeSession(context.Background(), "denied", nil); err != gorvpOauth2.ErrDeviceAccessDenied {
+		t.Errorf("expected access_denied, got %v", err)
+	}
+	// a device code is decided once
+	if err := store.DecideDeviceCode(record, "user", &fosite.Request{Client: &GoRvpClient{ID: "tv"}}); err == nil {
+		t.Error("expected the second decision to fail")
+	}
+}
+
+func TestGetDeviceCodeSessionApproved(t *testing.T) {
+	store := newTestStore(t)
+	record := createTestDeviceCode(t, store, "approved", 0, time.Minute)
+	req := &fosite.Request{
+		Client:        &GoRvpClient{ID: "tv"},
+		GrantedScopes: fosite.Arguments{"profile"},
+		Session:       &Session{},
+	}
+	if err := store.DecideDeviceCode(record, "user", req); err != nil {
+		t.Fatal(err)
+	}
+
+	approved, err := store.GetDeviceCodeSession(context.Background(), "approved", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if approved.GetClient().GetID() != "tv" || !approved.GetGrantedScopes().Has("profile") {
+		t.Errorf("unexpected request %+v", approved)
+	}
+
+	// only one of the concurrent polls gets the tokens
+	if err := store.RedeemDeviceCode(context.Background(), "approved"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err := store.RedeemDeviceCode(context.Background(), "approved"); err != fosite.ErrInvalidGrant {
+		t.Errorf("expected the second redemption to fail, got %v", err)
+	}
+	if _, err := store.GetDeviceCodeSession(context.Background(), "approved", nil); err != fosite.ErrInvalidGrant {
+		t.Errorf("expected invalid_grant for the redeemed code, got %v", err)
+	}
+}
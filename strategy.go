@@ -0,0 +1,195 @@
+package gorvp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/ory-am/fosite"
+	"github.com/ory-am/fosite/token/jwt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// lifespan of the id tokens
+const idTokenLifespan = time.Hour
+
+// minimum length of the nonce of the openid connect requests
+const minNonceLength = 8
+
+// GoRvpStrategy signs the tokens issued by gorvp, including the id tokens,
+// with the signing key of the keyring and sets its kid in the header. Tokens
+// are validated with the key of their kid as long as it is not retired.
+type GoRvpStrategy struct {
+	Keyring *Keyring
+}
+
+func NewGoRvpStrategy(keyring *Keyring) *GoRvpStrategy {
+	return &GoRvpStrategy{Keyring: keyring}
+}
+
+func (s *GoRvpStrategy) AccessTokenSignature(token string) string {
+	return signatureOf(token)
+}
+
+func (s *GoRvpStrategy) RefreshTokenSignature(token string) string {
+	return signatureOf(token)
+}
+
+func (s *GoRvpStrategy) AuthorizeCodeSignature(token string) string {
+	return signatureOf(token)
+}
+
+func (s *GoRvpStrategy) GenerateAccessToken(_ context.Context, requester fosite.Requester) (token string, signature string, err error) {
+	return s.generate(fosite.AccessToken, requester)
+}
+
+func (s *GoRvpStrategy) GenerateRefreshToken(_ context.Context, requester fosite.Requester) (token string, signature string, err error) {
+	return s.generate(fosite.RefreshToken, requester)
+}
+
+func (s *GoRvpStrategy) GenerateAuthorizeCode(_ context.Context, requester fosite.Requester) (token string, signature string, err error) {
+	return s.generate(fosite.AuthorizeCode, requester)
+}
+
+func (s *GoRvpStrategy) ValidateAccessToken(_ context.Context, _ fosite.Requester, token string) error {
+	return s.validate(token)
+}
+
+func (s *GoRvpStrategy) ValidateRefreshToken(_ context.Context, _ fosite.Requester, token string) error {
+	return s.validate(token)
+}
+
+func (s *GoRvpStrategy) ValidateAuthorizeCode(_ context.Context, _ fosite.Requester, token string) error {
+	return s.validate(token)
+}
+
+// GenerateIDToken issues the openid connect id token of requester.
+func (s *GoRvpStrategy) GenerateIDToken(_ context.Context, _ *http.Request, requester fosite.Requester) (token string, err error) {
+	session, ok := requester.GetSession().(*Session)
+	if !ok || session.IDClaims == nil {
+		return "", errors.Wrap(fosite.ErrServerError, "the session has no id token claims")
+	}
+
+	claims := session.IDClaims
+	nonce := requester.GetRequestForm().Get("nonce")
+	if nonce != "" && len(nonce) < minNonceLength {
+		return "", errors.Wrap(fosite.ErrInsufficientEntropy, "the nonce is too short")
+	}
+	claims.Nonce = nonce
+	claims.Audience = requester.GetClient().GetID()
+	claims.IssuedAt = time.Now()
+	claims.ExpiresAt = claims.IssuedAt.Add(idTokenLifespan)
+
+	token, _, err = s.sign(claims.ToMapClaims(), session.IDHeaders)
+	return token, err
+}
+
+// Decode verifies the token with the key of its kid. Tokens issued before the
+// keyring have no kid and are verified with every key which is not retired.
+func (s *GoRvpStrategy) Decode(token string) (*jwtgo.Token, error) {
+	keys, err := s.keysOf(token)
+	if err != nil {
+		return nil, err
+	}
+	var parsed *jwtgo.Token
+	for _, key := range keys {
+		parsed, err = jwtgo.Parse(token, func(t *jwtgo.Token) (interface{}, error) {
+			if t.Method.Alg() != key.Algorithm() {
+				return nil, errors.Errorf("unexpected signing method %s", t.Method.Alg())
+			}
+			return key.Key.Public(), nil
+		})
+		// the next key may have signed it
+		if e, ok := err.(*jwtgo.ValidationError); ok &&
+			e.Errors&(jwtgo.ValidationErrorSignatureInvalid|jwtgo.ValidationErrorUnverifiable) != 0 {
+			continue
+		}
+		break
+	}
+	return parsed, err
+}
+
+func (s *GoRvpStrategy) generate(tokenType fosite.TokenType, requester fosite.Requester) (string, string, error) {
+	session, ok := requester.GetSession().(*Session)
+	if !ok || session.JWTSession == nil || session.JWTClaims == nil {
+		return "", "", errors.Wrap(fosite.ErrServerError, "the session has no token claims")
+	}
+
+	claims := session.JWTClaims
+	claims.ExpiresAt = session.GetExpiresAt(tokenType)
+	return s.sign(claims.ToMapClaims(), session.JWTHeader)
+}
+
+// sign signs claims with the signing key, the kid of the key is set in header.
+func (s *GoRvpStrategy) sign(claims jwtgo.MapClaims, header *jwt.Headers) (string, string, error) {
+	key := s.Keyring.SigningKey()
+	if header == nil {
+		header = &jwt.Headers{}
+	}
+	header.Add("kid", key.ID)
+
+	token := jwtgo.NewWithClaims(signingMethodOf(key.Algorithm()), claims)
+	for name, value := range header.ToMap() {
+		if name != "alg" {
+			token.Header[name] = value
+		}
+	}
+	rawToken, err := token.SignedString(key.Key)
+	if err != nil {
+		return "", "", errors.Wrap(fosite.ErrServerError, err.Error())
+	}
+	return rawToken, signatureOf(rawToken), nil
+}
+
+func (s *GoRvpStrategy) validate(token string) error {
+	_, err := s.Decode(token)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*jwtgo.ValidationError); ok {
+		switch {
+		case e.Errors&jwtgo.ValidationErrorMalformed != 0:
+			return errors.Wrap(fosite.ErrInvalidTokenFormat, err.Error())
+		case e.Errors&jwtgo.ValidationErrorExpired != 0:
+			return errors.Wrap(fosite.ErrTokenExpired, err.Error())
+		case e.Errors&(jwtgo.ValidationErrorSignatureInvalid|jwtgo.ValidationErrorUnverifiable) != 0:
+			return errors.Wrap(fosite.ErrTokenSignatureMismatch, err.Error())
+		}
+	}
+	if errors.Cause(err) == fosite.ErrInvalidTokenFormat || errors.Cause(err) == fosite.ErrTokenSignatureMismatch {
+		return err
+	}
+	return errors.Wrap(fosite.ErrRequestUnauthorized, err.Error())
+}
+
+// keysOf returns the key of the kid in the token header, tokens issued
+// before the keyring have no kid and are validated with the keys which are not
+// retired, the imported key among them.
+func (s *GoRvpStrategy) keysOf(token string) ([]*SigningKey, error) {
+	header := struct {
+		KeyID string `json:"kid"`
+	}{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fosite.ErrInvalidTokenFormat
+	}
+	content, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fosite.ErrInvalidTokenFormat
+	}
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, fosite.ErrInvalidTokenFormat
+	}
+	if header.KeyID == "" {
+		return s.Keyring.ValidationKeys(), nil
+	}
+	key, err := s.Keyring.Get(header.KeyID)
+	if err != nil {
+		return nil, fosite.ErrTokenSignatureMismatch
+	}
+	return []*SigningKey{key}, nil
+}
@@ -1,6 +1,7 @@
 package gorvp
 
 import (
+	"context"
 	"github.com/jinzhu/gorm"
 	"time"
 	"net/http"
@@ -28,12 +29,74 @@ type Token struct {
 	Client       GoRvpClient `gorm:"ForeignKey:id;AssociationForeignKey:client_id"`
 	ClientID     string
 	RefreshToken bool
+	// shared by the tokens issued in one grant and the ones refreshed from them
+	GrantID      string      `gorm:"index"`
 
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 	DeletedAt    *time.Time `sql:"index"`
 }
 
+// OpenIDConnectSession keeps the authorize request of a code with the openid
+// scope until the id token is issued at the token endpoint.
+type OpenIDConnectSession struct {
+	Signature string `gorm:"primary_key"`
+	DataJSON  string `gorm:"size:4095"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time `sql:"index"`
+}
+
+func (s *OpenIDConnectSession) TableName() string {
+	return "oauth_openid_connect_sessions"
+}
+
+// states of a device code
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+	// the tokens of the approved code are being issued
+	DeviceCodeRedeemed = "redeemed"
+)
+
+// DeviceCode is a device authorization request (RFC 8628) until its tokens
+// are issued, the device code is only kept as its hash. DataJSON is the
+// request approved by the user.
+type DeviceCode struct {
+	Signature    string `gorm:"primary_key"`
+	UserCode     string `gorm:"unique_index"`
+	ClientID     string `gorm:"index"`
+	ScopeString  string `gorm:"size:1023"`
+	State        string
+	UserID       string
+	DataJSON     string `gorm:"size:4095"`
+	// seconds the device waits between two polls
+	Interval     int
+	ExpiresAt    time.Time
+	LastPolledAt *time.Time
+
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (d *DeviceCode) TableName() string {
+	return "oauth_device_codes"
+}
+
+// UsedAssertion is the jti of a jwt assertion of a client, kept until the
+// assertion expires so it is accepted once (RFC 7523 section 3).
+type UsedAssertion struct {
+	ClientID  string    `gorm:"primary_key"`
+	JTI       string    `gorm:"primary_key"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+func (a *UsedAssertion) TableName() string {
+	return "oauth_used_assertions"
+}
+
 type ClientRevocation struct {
 	gorm.Model
 	ClientID string
@@ -70,7 +133,7 @@ func GetTokenClaimsFromCode(store *Store, r *http.Request) (*jwt.JWTClaims, *Con
 	if token == "" {
 		return nil, nil, ErrTokenNotFoundBearer
 	}
-	return getCodeClaims(store, token)
+	return getCodeClaims(r.Context(), store, token)
 }
 
 func GetTokenClaimsFromRefreshToken(store *Store, r *http.Request) (*jwt.JWTClaims, *Connection, error) {
@@ -78,7 +141,7 @@ func GetTokenClaimsFromRefreshToken(store *Store, r *http.Request) (*jwt.JWTClai
 	if token == "" {
 		return nil, nil, ErrTokenNotFoundBearer
 	}
-	return getTokenClaims(store, token)
+	return getTokenClaims(r.Context(), store, token)
 }
 
 func GetTokenClaimsFromBearer(store *Store, r *http.Request) (*jwt.JWTClaims, *Connection, error) {
@@ -86,12 +149,17 @@ func GetTokenClaimsFromBearer(store *Store, r *http.Request) (*jwt.JWTClaims, *C
 	if err != nil {
 		return nil, nil, ErrTokenNotFoundBearer
 	}
-	return getTokenClaims(store, token)
+	return getTokenClaims(r.Context(), store, token)
 }
 
-func getCodeClaims(store *Store, token string) (*jwt.JWTClaims, *Connection, error) {
+func getCodeClaims(ctx context.Context, store *Store, token string) (claims *jwt.JWTClaims, connection *Connection, err error) {
+	_, span := startSpan(ctx, "gorvp.get_code_claims")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	// parse token
-	parsedToken, err := GetTokenStrategy().Decode(token)
+	parsedToken, err := store.TokenStrategy.Decode(token)
 	if err != nil {
 		return nil, nil, ErrTokenInvalid
 	}
@@ -103,8 +171,8 @@ func getCodeClaims(store *Store, token string) (*jwt.JWTClaims, *Connection, err
 	}
 
 	// check connection
-	claims := JWTClaimsFromMap(parsedToken.Claims.(jwtgo.MapClaims))
-	connection, err := store.GetConnectionByID(claims.Get("cni").(string))
+	claims = JWTClaimsFromMap(parsedToken.Claims.(jwtgo.MapClaims))
+	connection, err = store.GetConnectionByID(claims.Get("cni").(string))
 	if err != nil {
 		return nil, nil, ErrTokenInvalid
 	}
@@ -112,9 +180,14 @@ func getCodeClaims(store *Store, token string) (*jwt.JWTClaims, *Connection, err
 	return claims, connection, nil
 }
 
-func getTokenClaims(store *Store, token string) (*jwt.JWTClaims, *Connection, error) {
+func getTokenClaims(ctx context.Context, store *Store, token string) (claims *jwt.JWTClaims, connection *Connection, err error) {
+	_, span := startSpan(ctx, "gorvp.get_token_claims")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	// parse token
-	parsedToken, err := GetTokenStrategy().Decode(token)
+	parsedToken, err := store.TokenStrategy.Decode(token)
 	if err != nil {
 		return nil, nil, ErrTokenInvalid
 	}
@@ -126,14 +199,14 @@ func getTokenClaims(store *Store, token string) (*jwt.JWTClaims, *Connection, er
 	}
 
 	// check client
-	claims := JWTClaimsFromMap(parsedToken.Claims.(jwtgo.MapClaims))
+	claims = JWTClaimsFromMap(parsedToken.Claims.(jwtgo.MapClaims))
 	_, err = store.GetClient(claims.Audience)
 	if err != nil {
 		return nil, nil, ErrTokenInvalid
 	}
 
 	// check connection
-	connection, err := store.GetConnectionByID(claims.Get("cni").(string))
+	connection, err = store.GetConnectionByID(claims.Get("cni").(string))
 	if err != nil {
 		return nil, nil, ErrTokenInvalid
 	}
@@ -3,6 +3,9 @@ package gorvp
 import (
 	"github.com/gorilla/mux"
 	"net/http"
+	"encoding/json"
+	"strings"
+	"time"
 	"github.com/ory-am/fosite/token/jwt"
 	"github.com/ory-am/fosite"
 )
@@ -21,7 +24,7 @@ func (h *TokenHandler) TokenRevocation(w http.ResponseWriter, r *http.Request) {
 	// find the token to delete
 	err := h.Store.DB.Preload("Client").First(tokenToDelete).Error
 	if err != nil {
-		WriteError(w, ErrRecordNotFound)
+		WriteRequestError(w, r, ErrRecordNotFound)
 		return
 	}
 
@@ -59,7 +62,7 @@ func (h *TokenHandler) TokenRevocation(w http.ResponseWriter, r *http.Request) {
 				err = ErrPermissionDenied
 				break
 			}
-			if h.Store.Authenticate(nil, username, password) != nil {
+			if h.Store.Authenticate(r.Context(), username, password) != nil {
 				err = ErrPermissionDenied
 				break
 			}
@@ -73,19 +76,160 @@ func (h *TokenHandler) TokenRevocation(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 
-	// delete token
-	err = h.Store.DB.Delete(tokenToDelete).Error
+	// delete token, a refresh token with the tokens of its grant
+	err = h.Store.RevokeToken(tokenToDelete)
 	if err != nil {
-		WriteError(w, err)
+		WriteRequestError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// IntrospectionResponse is the response of the introspection endpoint (RFC 7662),
+// only active is set for an inactive token.
+type IntrospectionResponse struct {
+	Active       bool   `json:"active"`
+	Scope        string `json:"scope,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	Subject      string `json:"sub,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresAt    int64  `json:"exp,omitempty"`
+	IssuedAt     int64  `json:"iat,omitempty"`
+	Issuer       string `json:"iss,omitempty"`
+	ConnectionID string `json:"cni,omitempty"`
+}
+
+func (h *TokenHandler) TokenIntrospection(w http.ResponseWriter, r *http.Request) {
+	client, err := h.authenticateClient(r, false)
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if entry := GetAccessLogEntry(r); entry != nil {
+		entry.ClientID = client.GetID()
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		WriteRequestError(w, r, ErrTokenNotFoundCode)
+		return
+	}
+
+	// expired, deleted, or its connection is revoked
+	response := &IntrospectionResponse{}
+	claims, connection, err := getTokenClaims(r.Context(), h.Store, token)
+	if err == nil {
+		response = &IntrospectionResponse{
+			Active:       true,
+			Scope:        strings.Join(GetScopeArgumentFromClaims(claims), " "),
+			ClientID:     claims.Audience,
+			Subject:      claims.Subject,
+			TokenType:    "Bearer",
+			ExpiresAt:    unixOf(claims.ExpiresAt),
+			IssuedAt:     unixOf(claims.IssuedAt),
+			Issuer:       claims.Issuer,
+			ConnectionID: connection.ID,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// TokenRevocationRFC7009 revokes an access or refresh token of the authenticated
+// client, the access tokens issued with a refresh token are revoked with it.
+// token_type_hint is not needed as both are looked up by the signature.
+func (h *TokenHandler) TokenRevocationRFC7009(w http.ResponseWriter, r *http.Request) {
+	client, err := h.authenticateClient(r, true)
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	if entry := GetAccessLogEntry(r); entry != nil {
+		entry.ClientID = client.GetID()
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		WriteRequestError(w, r, ErrTokenNotFoundCode)
+		return
+	}
+
+	// unknown and already revoked tokens are not an error
+	tokenToRevoke, err := h.Store.GetToken(signatureOf(token))
+	if err != nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if tokenToRevoke.ClientID != client.GetID() {
+		WriteRequestError(w, r, ErrPermissionDenied)
+		return
+	}
+
+	err = h.Store.RevokeToken(tokenToRevoke)
+	if err != nil {
+		WriteRequestError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateClient checks the client credentials in the basic auth header,
+// or in the client_id and client_secret form values. Public clients only
+// need the client id if allowPublic is set.
+func (h *TokenHandler) authenticateClient(r *http.Request, allowPublic bool) (*GoRvpClient, error) {
+	r.ParseForm()
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	// private_key_jwt, the assertion is verified in place of the secret
+	if assertionClientID, assertion, ok := clientAssertionOf(r); ok {
+		client, err := h.Store.GetRvpClient(assertionClientID)
+		if err != nil || client.JWKS == nil {
+			return nil, ErrInvalidClient
+		}
+		if err := h.Store.VerifyAssertion(r.Context(), assertionClientID, assertion); err != nil {
+			return nil, ErrInvalidClient
+		}
+		return client, nil
+	}
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, err := h.Store.GetRvpClient(clientID)
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	if allowPublic && client.IsPublic() {
+		return client, nil
+	}
+	if err := h.Hasher.Compare(client.GetHashedSecret(), []byte(clientSecret)); err != nil {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// signatureOf returns the signature part of a jwt, which is the key of the token in the store.
+func signatureOf(token string) string {
+	parts := strings.Split(token, ".")
+	return parts[len(parts)-1]
+}
+
+func unixOf(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
 func (h *TokenHandler) SetupHandler() {
 	h.Routes = Routes{
 		Route{
@@ -0,0 +1,104 @@
+package gorvp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jacyzon/gorvp"
+
+// tracePropagator reads and writes the W3C traceparent and baggage headers.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Tracing creates the root span of every request, the spans below it are
+// created from the tracer provider of the parent span, see startSpan.
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func NewTracing(doc TracingDocument) (*Tracing, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(doc.Endpoint)}
+	if doc.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := doc.ServiceName
+	if serviceName == "" {
+		serviceName = "gorvp"
+	}
+	sampleRatio := doc.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	return &Tracing{
+		provider: provider,
+		tracer:   provider.Tracer(tracerName),
+	}, nil
+}
+
+func (t *Tracing) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := t.tracer.Start(ctx, r.Method+" "+hostnameOf(r.Host),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("gorvp.request_id", GetRequestID(r)),
+		))
+	defer span.End()
+
+	next(rw, r.WithContext(ctx))
+
+	status := rw.(negroni.ResponseWriter).Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// Shutdown flushes the pending spans to the collector.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// startSpan starts a child span of the span in ctx, it is a no-op span if
+// tracing is disabled.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan records err on the span before ending it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// newTracingTransport propagates the trace context to the backends.
+func newTracingTransport() http.RoundTripper {
+	return otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithPropagators(tracePropagator))
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package gorvp
+
+import (
+	"os"
+	"syscall"
+)
+
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
@@ -0,0 +1,12 @@
+package gorvp
+
+import (
+	"os"
+)
+
+// binary upgrade is not supported on windows
+var upgradeSignals = []os.Signal{}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return false
+}